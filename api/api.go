@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/eskoltech/ethstats-server/chain"
+	"github.com/eskoltech/ethstats-server/service"
+	"github.com/eskoltech/ethstats-server/storage"
+)
+
+// Root is the prefix of the read-only HTTP API endpoints
+const Root string = "/v1/"
+
+// errorResponse is the body sent when a request fails
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler serves the read-only HTTP API with the state of the nodes and the
+// network. It's safe for concurrent use
+type Handler struct {
+	service  *service.Channel
+	engine   *chain.Engine
+	detector *chain.Detector
+	store    storage.Store
+}
+
+// New creates a new Handler that reads the nodes from the service, the
+// blocks and network stats from the engine, the forks and reorgs from the
+// detector, and the history from the store
+func New(service *service.Channel, engine *chain.Engine, detector *chain.Detector, store storage.Store) *Handler {
+	defer func() { service.Log().Info("HTTP API started successfully") }()
+	return &Handler{service: service, engine: engine, detector: detector, store: store}
+}
+
+// ServeHTTP routes the API requests to each endpoint
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, Root), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "nodes":
+		h.nodes(w, r)
+	case len(parts) == 2 && parts[0] == "nodes":
+		h.node(w, r, parts[1])
+	case len(parts) == 4 && parts[0] == "nodes" && parts[2] == "history":
+		h.history(w, r, parts[1], parts[3])
+	case path == "blocks/latest":
+		h.latestBlock(w, r)
+	case len(parts) == 2 && parts[0] == "blocks":
+		h.block(w, r, parts[1])
+	case path == "network":
+		h.writeJSON(w, r, h.engine.Network())
+	case path == "forks":
+		forks := h.detector.Forks()
+		if forks == nil {
+			forks = []chain.Fork{}
+		}
+		h.writeJSON(w, r, forks)
+	case path == "reorgs":
+		reorgs := h.detector.Reorgs()
+		if reorgs == nil {
+			reorgs = []chain.Reorg{}
+		}
+		h.writeJSON(w, r, reorgs)
+	default:
+		writeError(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+// latestBlock writes the best block known by the engine
+func (h *Handler) latestBlock(w http.ResponseWriter, r *http.Request) {
+	block, ok := h.engine.Best()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no blocks reported yet")
+		return
+	}
+	h.writeJSON(w, r, block)
+}
+
+// block writes the block with the given number, if it's in the engine window
+func (h *Handler) block(w http.ResponseWriter, r *http.Request, param string) {
+	number, err := strconv.ParseUint(param, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid block number %q", param))
+		return
+	}
+	block, ok := h.engine.Block(number)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("block %d not found", number))
+		return
+	}
+	h.writeJSON(w, r, block)
+}
+
+// writeJSON writes the value as JSON with an ETag computed from the body. If
+// the client already has the same representation, only the status is sent
+func (h *Handler) writeJSON(w http.ResponseWriter, r *http.Request, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		h.service.Log().Errorf("Can't encode API response for %s, error: %s", r.URL.Path, err)
+		writeError(w, http.StatusInternalServerError, "can't encode response")
+		return
+	}
+	hash := fnv.New64a()
+	hash.Write(body)
+	etag := fmt.Sprintf(`"%x"`, hash.Sum64())
+	w.Header().Set("ETag", etag)
+	if matches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(body)
+}
+
+// matches return true if the If-None-Match header contains the given ETag
+func matches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeError writes the error message with the given status
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg})
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/storage"
+)
+
+// defaultRange is the time range of the history returned when no range is requested
+const defaultRange = time.Hour
+
+// History is the stored history of a node metric
+type History struct {
+	Node   string      `json:"node"`
+	Metric string      `json:"metric"`
+	Tier   string      `json:"tier"`
+	From   time.Time   `json:"from"`
+	To     time.Time   `json:"to"`
+	Points interface{} `json:"points"`
+}
+
+// history writes the samples, or the rollups of the requested tier, of the
+// node metric in the requested time range
+func (h *Handler) history(w http.ResponseWriter, r *http.Request, id, metric string) {
+	if _, ok := h.service.Nodes.Get(id); !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("node %q not found", id))
+		return
+	}
+	query := r.URL.Query()
+	to, err := timeParam(query, "to", time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := timeParam(query, "from", to.Add(-defaultRange))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tier := query.Get("tier")
+	if tier == "" {
+		tier = storage.Raw
+	}
+	history := History{Node: id, Metric: metric, Tier: tier, From: from, To: to}
+	switch tier {
+	case storage.Raw:
+		samples, err := h.store.Samples(id, metric, from, to)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		history.Points = samples
+	case storage.Minute, storage.Hour, storage.Day:
+		rollups, err := h.store.Rollups(tier, id, metric, from, to)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		history.Points = rollups
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid tier %q, use raw, 1m, 1h or 1d", tier))
+		return
+	}
+	h.writeJSON(w, r, history)
+}
+
+// timeParam return the time query parameter with the given name, as RFC 3339
+// or seconds since the epoch, or the default value if it's not present
+func timeParam(query url.Values, name string, def time.Time) (time.Time, error) {
+	param := query.Get(name)
+	if param == "" {
+		return def, nil
+	}
+	if seconds, err := strconv.ParseInt(param, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q", name, param)
+	}
+	return t, nil
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+)
+
+const (
+	// defaultLimit is the number of nodes returned when no limit is requested
+	defaultLimit = 100
+	// maxLimit is the maximum number of nodes returned in a single page
+	maxLimit = 1000
+)
+
+// Node is the state of a node returned by the API
+type Node struct {
+	ID          string          `json:"id"`
+	Label       string          `json:"label,omitempty"`
+	Status      string          `json:"status"`
+	Connections int             `json:"connections"`
+	Messages    uint64          `json:"messages"`
+	FirstSeen   time.Time       `json:"firstSeen"`
+	LastSeen    time.Time       `json:"lastSeen"`
+	Info        json.RawMessage `json:"info,omitempty"`
+	Block       json.RawMessage `json:"block,omitempty"`
+	Stats       json.RawMessage `json:"stats,omitempty"`
+	Pending     json.RawMessage `json:"pending,omitempty"`
+	Latency     json.RawMessage `json:"latency,omitempty"`
+	Propagation json.RawMessage `json:"propagation,omitempty"`
+}
+
+// NodePage is a page of the list of nodes
+type NodePage struct {
+	Nodes  []Node `json:"nodes"`
+	Total  int    `json:"total"`
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit"`
+}
+
+// nodes writes the page of nodes that match the label and status filters
+func (h *Handler) nodes(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	offset, err := intParam(query, "offset", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, err := intParam(query, "limit", defaultLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	status := query.Get("status")
+	if status != "" && status != "active" && status != "inactive" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid status %q, use active or inactive", status))
+		return
+	}
+	label := query.Get("label")
+
+	var matched []service.Node
+	for _, node := range h.service.Nodes.Snapshot() {
+		if label != "" && node.Label != label {
+			continue
+		}
+		if status != "" && nodeStatus(node) != status {
+			continue
+		}
+		matched = append(matched, node)
+	}
+	page := NodePage{Nodes: []Node{}, Total: len(matched), Offset: offset, Limit: limit}
+	for i := offset; i < len(matched) && i < offset+limit; i++ {
+		page.Nodes = append(page.Nodes, newNode(matched[i]))
+	}
+	h.writeJSON(w, r, page)
+}
+
+// node writes the node with the given id
+func (h *Handler) node(w http.ResponseWriter, r *http.Request, id string) {
+	node, ok := h.service.Nodes.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("node %q not found", id))
+		return
+	}
+	h.writeJSON(w, r, newNode(node))
+}
+
+// newNode builds the API representation of a registered node, using the last
+// messages it reported
+func newNode(node service.Node) Node {
+	return Node{
+		ID:          node.ID,
+		Label:       node.Label,
+		Status:      nodeStatus(node),
+		Connections: node.Connections,
+		Messages:    node.Messages,
+		FirstSeen:   node.FirstSeen,
+		LastSeen:    node.LastSeen,
+		Info:        field(node.Hello, "info"),
+		Block:       field(node.Latest[message.TypeBlock], "block"),
+		Stats:       field(node.Latest[message.TypeStats], "stats"),
+		Pending:     field(node.Latest[message.TypePending], "stats"),
+		Latency:     field(node.Latest[message.TypeLatency], "latency"),
+		Propagation: value(node.Latest[message.TypePropagation]),
+	}
+}
+
+// nodeStatus return active if the node is connected, otherwise inactive
+func nodeStatus(node service.Node) string {
+	if node.Active {
+		return "active"
+	}
+	return "inactive"
+}
+
+// value return the value of the message content, nil if it can't be parsed
+func value(content []byte) json.RawMessage {
+	if content == nil {
+		return nil
+	}
+	msg, err := message.Parse(content)
+	if err != nil {
+		return nil
+	}
+	return msg.Value
+}
+
+// field return the given field of the message value, nil if it's not present
+func field(content []byte, name string) json.RawMessage {
+	raw := value(content)
+	if raw == nil {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil
+	}
+	return fields[name]
+}
+
+// intParam return the non negative integer query parameter with the given
+// name, or the default value if it's not present
+func intParam(query url.Values, name string, def int) (int, error) {
+	param := query.Get(name)
+	if param == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(param)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, param)
+	}
+	return n, nil
+}
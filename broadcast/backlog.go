@@ -0,0 +1,48 @@
+package broadcast
+
+// backlog keeps the last messages sent to the clients, so clients that
+// reconnect can receive the messages they missed. It's only used from the hub
+// goroutine
+type backlog struct {
+	items []item
+	start int
+	size  int
+}
+
+// newBacklog creates a new backlog that keeps the given number of messages
+func newBacklog(size int) *backlog {
+	return &backlog{items: make([]item, 0, size), size: size}
+}
+
+// add adds the item to the backlog, removing the oldest one if it's full
+func (b *backlog) add(i item) {
+	if b.size <= 0 {
+		return
+	}
+	if len(b.items) < b.size {
+		b.items = append(b.items, i)
+		return
+	}
+	b.items[b.start] = i
+	b.start = (b.start + 1) % b.size
+}
+
+// since return the items sent after the one with the given id. If some of
+// them aren't kept anymore, or the id is unknown, false is returned
+func (b *backlog) since(id uint64) ([]item, bool) {
+	if len(b.items) == 0 {
+		return nil, false
+	}
+	oldest := b.items[b.start]
+	newest := b.items[(b.start+len(b.items)-1)%len(b.items)]
+	if id+1 < oldest.id || id > newest.id {
+		return nil, false
+	}
+	var items []item
+	for n := 0; n < len(b.items); n++ {
+		if i := b.items[(b.start+n)%len(b.items)]; i.id > id {
+			items = append(items, i)
+		}
+	}
+	return items, true
+}
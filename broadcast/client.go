@@ -0,0 +1,128 @@
+package broadcast
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sender writes the messages to a client using a transport, like websocket
+// or server-sent events
+type sender interface {
+	// send writes the item to the client
+	send(i item) error
+
+	// receive blocks until the client goes away, calling handle with every
+	// message sent by the client
+	receive(handle func(content []byte)) error
+
+	// close closes the transport
+	close() error
+
+	// addr return the address of the client
+	addr() string
+}
+
+// client is a dashboard client registered in the hub. Messages are queued and
+// written by its own goroutine, so a slow client never blocks the hub
+type client struct {
+	sender sender
+	queue  *queue
+	done   chan struct{}
+	once   sync.Once
+
+	// filter selects the messages sent to the client. Once the client is
+	// registered, it's only used from the hub goroutine
+	filter *Filter
+
+	// resume is the id of the last message received by the client before
+	// reconnecting, if resuming is true
+	resume   uint64
+	resuming bool
+}
+
+// newClient creates a new client for the sender, with a queue of the given
+// size and overflow policy
+func newClient(sender sender, size int, policy OverflowPolicy) *client {
+	return &client{
+		sender: sender,
+		queue:  newQueue(size, policy),
+		done:   make(chan struct{}),
+	}
+}
+
+// writeLoop writes the queued messages until the client is closed or a write fails
+func (c *client) writeLoop(m *metrics) error {
+	var items []item
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case <-c.queue.ready:
+			items = c.queue.pop(items)
+			for _, i := range items {
+				if err := c.sender.send(i); err != nil {
+					return err
+				}
+				atomic.AddUint64(&m.sent, 1)
+			}
+		}
+	}
+}
+
+// readLoop blocks until the client goes away, calling handle with every
+// message sent by the client
+func (c *client) readLoop(handle func(content []byte)) error {
+	return c.sender.receive(handle)
+}
+
+// close closes the client queue and connection. It's safe to call it more than once
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.queue.close()
+		c.sender.close()
+	})
+}
+
+// wsSender sends the messages to a websocket client
+type wsSender struct {
+	conn    *websocket.Conn
+	timeout time.Duration
+}
+
+// send writes the item to the connection, using the prepared frame if any.
+// Each write must finish before the timeout, if not zero
+func (w *wsSender) send(i item) error {
+	if w.timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	if i.prepared != nil {
+		return w.conn.WritePreparedMessage(i.prepared)
+	}
+	return w.conn.WriteMessage(websocket.TextMessage, i.data)
+}
+
+// receive reads from the client until the connection is closed. Reading is
+// also required to process the control frames
+func (w *wsSender) receive(handle func(content []byte)) error {
+	for {
+		_, content, err := w.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		handle(content)
+	}
+}
+
+// close closes the websocket connection
+func (w *wsSender) close() error {
+	return w.conn.Close()
+}
+
+// addr return the remote address of the connection
+func (w *wsSender) addr() string {
+	return w.conn.RemoteAddr().String()
+}
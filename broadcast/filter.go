@@ -0,0 +1,191 @@
+package broadcast
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/eskoltech/ethstats-server/message"
+)
+
+// Filter selects the messages sent to a client. Messages that aren't about a
+// node, like charts, are only filtered by type. A nil set accepts any value,
+// and an empty one accepts none, so a nil filter matches all messages
+type Filter struct {
+	// Types are the accepted message types
+	Types map[string]bool
+
+	// Nodes are the ids of the accepted nodes
+	Nodes map[string]bool
+
+	// Labels are the labels of the accepted nodes
+	Labels map[string]bool
+
+	// except contains the values unsubscribed while any value was accepted,
+	// the messages that match any of them are rejected
+	except *Filter
+}
+
+// ParseFilter return the filter defined in the query parameters types, nodes
+// and labels. Each parameter is a comma separated list of values
+func ParseFilter(query url.Values) *Filter {
+	return &Filter{
+		Types:  parseSet(query.Get("types")),
+		Nodes:  parseSet(query.Get("nodes")),
+		Labels: parseSet(query.Get("labels")),
+	}
+}
+
+// newFilter return the filter of a subscription
+func newFilter(s message.Subscription) *Filter {
+	return &Filter{Types: newSet(s.Types), Nodes: newSet(s.Nodes), Labels: newSet(s.Labels)}
+}
+
+// newSet return the set of the given values, nil if empty
+func newSet(values []string) map[string]bool {
+	var set map[string]bool
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		if set == nil {
+			set = make(map[string]bool)
+		}
+		set[value] = true
+	}
+	return set
+}
+
+// parseSet return the set of values of a comma separated list, nil if empty
+func parseSet(list string) map[string]bool {
+	values := strings.Split(list, ",")
+	for n := range values {
+		values[n] = strings.TrimSpace(values[n])
+	}
+	return newSet(values)
+}
+
+// subscribe return a new filter that also accepts the values of the given one
+func (f *Filter) subscribe(s *Filter) *Filter {
+	if f == nil {
+		return s
+	}
+	result := &Filter{
+		Types:  union(f.Types, s.Types),
+		Nodes:  union(f.Nodes, s.Nodes),
+		Labels: union(f.Labels, s.Labels),
+	}
+	if f.except != nil {
+		result.except = &Filter{
+			Types:  difference(f.except.Types, s.Types),
+			Nodes:  difference(f.except.Nodes, s.Nodes),
+			Labels: difference(f.except.Labels, s.Labels),
+		}
+	}
+	return result
+}
+
+// unsubscribe return a new filter that doesn't accept the values of the given
+// one, so it never accepts more messages than before. If the given filter is
+// empty, the result accepts all messages
+func (f *Filter) unsubscribe(s *Filter) *Filter {
+	if s.empty() {
+		return nil
+	}
+	if f == nil {
+		f = &Filter{}
+	}
+	except := &Filter{Types: s.Types, Nodes: s.Nodes, Labels: s.Labels}
+	if f.except != nil {
+		except = &Filter{
+			Types:  merge(f.except.Types, s.Types),
+			Nodes:  merge(f.except.Nodes, s.Nodes),
+			Labels: merge(f.except.Labels, s.Labels),
+		}
+	}
+	return &Filter{
+		Types:  difference(f.Types, s.Types),
+		Nodes:  difference(f.Nodes, s.Nodes),
+		Labels: difference(f.Labels, s.Labels),
+		except: except,
+	}
+}
+
+// empty return true if the filter doesn't contain any value
+func (f *Filter) empty() bool {
+	return f == nil || len(f.Types) == 0 && len(f.Nodes) == 0 && len(f.Labels) == 0
+}
+
+// union return a new set that accepts the values of both sets. Since a nil set
+// accepts any value, the result is nil if any of them is nil
+func union(a, b map[string]bool) map[string]bool {
+	if a == nil || b == nil {
+		return nil
+	}
+	return merge(a, b)
+}
+
+// merge return a new set with the values of both sets, nil if both are nil
+func merge(a, b map[string]bool) map[string]bool {
+	if a == nil && b == nil {
+		return nil
+	}
+	set := make(map[string]bool, len(a)+len(b))
+	for value := range a {
+		set[value] = true
+	}
+	for value := range b {
+		set[value] = true
+	}
+	return set
+}
+
+// difference return a new set with the values of a that aren't in b. If a is
+// nil, the result is nil, otherwise it's a set even if it's empty
+func difference(a, b map[string]bool) map[string]bool {
+	if a == nil {
+		return nil
+	}
+	set := make(map[string]bool, len(a))
+	for value := range a {
+		if !b[value] {
+			set[value] = true
+		}
+	}
+	return set
+}
+
+// match return true if the message of the given type and node is accepted.
+// The label function return the label of a node
+func (f *Filter) match(msgType, id string, label func(id string) string) bool {
+	if f == nil {
+		return true
+	}
+	if f.except.excludes(msgType, id, label) {
+		return false
+	}
+	if f.Types != nil && msgType != "" && !f.Types[msgType] {
+		return false
+	}
+	if id == "" {
+		return true
+	}
+	if f.Nodes != nil && !f.Nodes[id] {
+		return false
+	}
+	if f.Labels != nil && !f.Labels[label(id)] {
+		return false
+	}
+	return true
+}
+
+// excludes return true if the message of the given type and node matches any
+// value of the filter
+func (f *Filter) excludes(msgType, id string, label func(id string) string) bool {
+	if f == nil {
+		return false
+	}
+	if f.Types[msgType] {
+		return true
+	}
+	return id != "" && (f.Nodes[id] || len(f.Labels) > 0 && f.Labels[label(id)])
+}
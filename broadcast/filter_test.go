@@ -0,0 +1,87 @@
+package broadcast
+
+import (
+	"testing"
+
+	"github.com/eskoltech/ethstats-server/message"
+)
+
+// noLabel is the label function of nodes without label
+func noLabel(id string) string { return "" }
+
+func TestUnsubscribeLastValue(t *testing.T) {
+	var f *Filter
+	f = f.subscribe(newFilter(message.Subscription{Types: []string{message.TypeBlock}}))
+	f = f.unsubscribe(newFilter(message.Subscription{Types: []string{message.TypeBlock}}))
+	for _, msgType := range []string{message.TypeBlock, message.TypeStats, message.TypeCharts} {
+		if f.match(msgType, "node-1", noLabel) {
+			t.Errorf("%s message accepted after unsubscribing the only subscribed type", msgType)
+		}
+	}
+}
+
+func TestUnsubscribeWithoutFilter(t *testing.T) {
+	var f *Filter
+	f = f.unsubscribe(newFilter(message.Subscription{Types: []string{message.TypeStats}}))
+	if f.match(message.TypeStats, "node-1", noLabel) {
+		t.Error("stats message accepted after unsubscribing stats")
+	}
+	if !f.match(message.TypeBlock, "node-1", noLabel) {
+		t.Error("block message rejected after unsubscribing stats")
+	}
+	f = f.subscribe(newFilter(message.Subscription{Types: []string{message.TypeStats}}))
+	for _, msgType := range []string{message.TypeStats, message.TypeBlock, message.TypeCharts} {
+		if !f.match(msgType, "node-1", noLabel) {
+			t.Errorf("%s message rejected after subscribing stats again", msgType)
+		}
+	}
+}
+
+func TestSubscribeNeverNarrows(t *testing.T) {
+	var f *Filter
+	f = f.subscribe(newFilter(message.Subscription{Types: []string{message.TypeBlock}}))
+	if f.match(message.TypeStats, "node-1", noLabel) {
+		t.Error("stats message accepted after subscribing only blocks")
+	}
+	f = f.subscribe(newFilter(message.Subscription{Nodes: []string{"node-1"}}))
+	for _, id := range []string{"node-1", "node-2"} {
+		if !f.match(message.TypeBlock, id, noLabel) {
+			t.Errorf("block message of %s rejected after subscribing node-1", id)
+		}
+	}
+	if !f.match(message.TypeStats, "node-1", noLabel) {
+		t.Error("stats message of node-1 rejected after subscribing node-1")
+	}
+}
+
+func TestSubscribeAddsValues(t *testing.T) {
+	var f *Filter
+	f = f.subscribe(newFilter(message.Subscription{Types: []string{message.TypeBlock}}))
+	f = f.subscribe(newFilter(message.Subscription{Types: []string{message.TypeStats}}))
+	if !f.match(message.TypeBlock, "node-1", noLabel) || !f.match(message.TypeStats, "node-1", noLabel) {
+		t.Error("subscribed types rejected")
+	}
+	if f.match(message.TypePending, "node-1", noLabel) {
+		t.Error("pending message accepted without subscribing it")
+	}
+}
+
+func TestUnsubscribeNode(t *testing.T) {
+	var f *Filter
+	f = f.unsubscribe(newFilter(message.Subscription{Nodes: []string{"node-1"}}))
+	if f.match(message.TypeBlock, "node-1", noLabel) {
+		t.Error("message of node-1 accepted after unsubscribing node-1")
+	}
+	if !f.match(message.TypeBlock, "node-2", noLabel) || !f.match(message.TypeCharts, "", noLabel) {
+		t.Error("messages of other nodes rejected after unsubscribing node-1")
+	}
+}
+
+func TestUnsubscribeAll(t *testing.T) {
+	var f *Filter
+	f = f.subscribe(newFilter(message.Subscription{Types: []string{message.TypeBlock}}))
+	f = f.unsubscribe(newFilter(message.Subscription{}))
+	if !f.match(message.TypeStats, "node-1", noLabel) {
+		t.Error("empty unsubscribe didn't go back to receiving all messages")
+	}
+}
@@ -1,67 +1,286 @@
 package broadcast
 
 import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
 	"github.com/eskoltech/ethstats-server/service"
 	"github.com/gorilla/websocket"
-	log "github.com/sirupsen/logrus"
-	"time"
 )
 
+// retainedTypes are the messages emitted by this server whose last value is
+// sent to new clients
+var retainedTypes = []string{
+	message.TypeMiners,
+	message.TypeCharts,
+}
+
+// Stats contains the counters of the messages handled by the hub
+type Stats struct {
+	// Clients is the number of registered clients
+	Clients int64
+
+	// Sent is the number of messages written to clients
+	Sent uint64
+
+	// Dropped is the number of messages dropped because a client queue was full
+	Dropped uint64
+
+	// Coalesced is the number of queued messages replaced by newer ones
+	Coalesced uint64
+
+	// Evicted is the number of clients disconnected because their queue was full
+	Evicted uint64
+
+	// Broadcast is the number of messages sent to all clients, by type
+	Broadcast map[string]uint64
+}
+
+// metrics are the counters of the hub, updated atomically
+type metrics struct {
+	sent      uint64
+	dropped   uint64
+	coalesced uint64
+	evicted   uint64
+	clients   int64
+
+	lock      sync.Mutex
+	broadcast map[string]uint64
+}
+
+// count counts a message of the given type sent to all clients
+func (m *metrics) count(msgType string) {
+	m.lock.Lock()
+	m.broadcast[msgType]++
+	m.lock.Unlock()
+}
+
 // hub maintain a list of registered clients to send messages
 type hub struct {
-	register chan *websocket.Conn
-	close    chan interface{}
-	clients  map[*websocket.Conn]bool
-	service  *service.Channel
+	register   chan *client
+	unregister chan *client
+	commands   chan command
+	close      chan interface{}
+	done       chan struct{}
+	clients    map[*client]bool
+	service    *service.Channel
+	config     Config
+	encoder    encoder
+	metrics    *metrics
+
+	// retained contains the last message of each retained type, created
+	// when the first one is retained
+	retained map[string]service.Message
+
+	// sequence is the id of the last message sent to all clients, and
+	// backlog keeps the last ones so clients can resume after reconnecting
+	sequence uint64
+	backlog  *backlog
 }
 
 // loop loops as the server is alive and send messages to registered clients
 func (h *hub) loop() {
 	nodesReport := time.NewTicker(15 * time.Second)
+	defer nodesReport.Stop()
 	for {
 		select {
-		case msg := <-h.service.Message:
-			if len(h.clients) == 0 {
-				continue
+		case msg, ok := <-h.service.Message:
+			if !ok {
+				// the relay is closed, nothing else to send
+				h.quit()
+				return
 			}
 			h.writeMessage(msg)
-		case client := <-h.register:
-			h.clients[client] = true
+		case c := <-h.register:
+			h.clients[c] = true
+			atomic.AddInt64(&h.metrics.clients, 1)
+			h.sendInit(c)
+		case c := <-h.unregister:
+			h.remove(c)
+		case cmd := <-h.commands:
+			h.apply(cmd)
 		case <-h.close:
 			h.quit()
-			break
+			return
 		case <-nodesReport.C:
-			if len(h.service.Nodes) == 0 {
-				// Don't send anything if no nodes connected...
+			if len(h.clients) == 0 {
 				continue
 			}
-			for _, v := range h.service.Nodes {
-				h.writeMessage(v)
+			for _, msg := range h.encoder.refresh(h.service.Nodes.Snapshot()) {
+				h.fanOut(item{data: msg.Content, msgType: msg.Type, node: msg.Node})
 			}
 		}
 	}
 }
 
-// writeMessage to all registered clients. If an error occurs sending a message to a client,
-// then these connection is closed and removed from the pool of registered clients
-func (h *hub) writeMessage(msg []byte) {
-	for client := range h.clients {
-		err := client.WriteMessage(1, msg)
-		if err != nil {
-			log.Infof("Closed connection with client: %s", client.RemoteAddr())
-			// close and delete the client connection and release
-			client.Close()
-			delete(h.clients, client)
+// serve writes the messages to a registered client, and reads from it in a
+// new goroutine, until the client is closed. When any of them fails, the
+// client is unregistered
+func (h *hub) serve(c *client) {
+	go func() {
+		if err := c.readLoop(func(content []byte) { h.handle(c, content) }); err != nil {
+			h.leave(c)
 		}
+	}()
+	if err := c.writeLoop(h.metrics); err != nil {
+		h.service.Log().Infof("Error writing to client %s, %s", c.sender.addr(), err)
+		h.leave(c)
+	}
+}
+
+// leave asks the hub to unregister the client, unless the hub is closed
+func (h *hub) leave(c *client) {
+	select {
+	case h.unregister <- c:
+	case <-h.done:
+	}
+}
+
+// remove closes the client connection and removes it from the pool of registered clients
+func (h *hub) remove(c *client) {
+	if !h.clients[c] {
+		return
 	}
+	h.service.Log().Infof("Closed connection with client: %s", c.sender.addr())
+	delete(h.clients, c)
+	atomic.AddInt64(&h.metrics.clients, -1)
+	c.close()
 }
 
+// sendInit queues to a new client the current state of all known nodes, so
+// the client doesn't need to wait for the next reports. Clients resuming a
+// previous connection only receive the messages they missed, if they are
+// still in the backlog
+func (h *hub) sendInit(c *client) {
+	if c.resuming {
+		if missed, ok := h.backlog.since(c.resume); ok {
+			c.queue.pushAll(h.accepted(c, missed))
+			return
+		}
+	}
+	messages := h.encoder.init(h.service.Nodes.Snapshot())
+	for _, msgType := range retainedTypes {
+		if msg, ok := h.retained[msgType]; ok {
+			for _, content := range h.encoder.encode(msg.Content) {
+				messages = append(messages, service.Message{Content: content, Type: msg.Type, Node: msg.Node})
+			}
+		}
+	}
+	items := make([]item, 0, len(messages))
+	for _, msg := range messages {
+		items = append(items, item{data: msg.Content, msgType: msg.Type, node: msg.Node})
+	}
+	c.queue.pushAll(h.accepted(c, items))
+}
+
+// accepted return the items that match the filter of the client
+func (h *hub) accepted(c *client, items []item) []item {
+	if c.filter == nil {
+		return items
+	}
+	matched := make([]item, 0, len(items))
+	for _, i := range items {
+		if c.filter.match(i.msgType, i.node, h.service.Nodes.Label) {
+			matched = append(matched, i)
+		}
+	}
+	return matched
+}
+
+// writeMessage encodes the node message using the client protocol, keeps it
+// in the backlog and queues the result to all registered clients
+func (h *hub) writeMessage(msg service.Message) {
+	msgType, node := msg.Type, msg.Node
+	if msgType == "" {
+		h.service.Log().Warning("Message sent to clients without type, ignoring it")
+		return
+	}
+	h.retain(msg)
+	h.metrics.count(msgType)
+	if len(h.clients) == 0 && h.backlog.size == 0 {
+		return
+	}
+	key := ""
+	if h.config.Overflow == Coalesce && node != "" && msgType != message.TypeNodeEvent {
+		// node events are never coalesced
+		key = msgType + "/" + node
+	}
+	for _, content := range h.encoder.encode(msg.Content) {
+		h.sequence++
+		i := item{key: key, data: content, id: h.sequence, msgType: msgType, node: node}
+		h.backlog.add(i)
+		h.fanOut(i)
+	}
+}
+
+// retain keeps the message if its type is retained
+func (h *hub) retain(msg service.Message) {
+	for _, retained := range retainedTypes {
+		if msg.Type == retained {
+			if h.retained == nil {
+				h.retained = make(map[string]service.Message)
+			}
+			h.retained[msg.Type] = msg
+			return
+		}
+	}
+}
+
+// fanOut queues the item to all registered clients. It never blocks, if the
+// queue of a client is full the overflow policy is applied. The message frame
+// is prepared once and shared by all clients
+func (h *hub) fanOut(i item) {
+	if len(h.clients) == 0 {
+		return
+	}
+	prepared, err := websocket.NewPreparedMessage(websocket.TextMessage, i.data)
+	if err != nil {
+		h.service.Log().Warningf("Can't prepare message for clients, error: %s", err)
+	} else {
+		i.prepared = prepared
+	}
+	for c := range h.clients {
+		if !c.filter.match(i.msgType, i.node, h.service.Nodes.Label) {
+			continue
+		}
+		switch c.queue.push(i) {
+		case droppedOldest:
+			atomic.AddUint64(&h.metrics.dropped, 1)
+		case coalesced:
+			atomic.AddUint64(&h.metrics.coalesced, 1)
+		case overflowed:
+			h.service.Log().Warningf("Client %s can't keep up with the messages, disconnecting", c.sender.addr())
+			atomic.AddUint64(&h.metrics.evicted, 1)
+			h.remove(c)
+		}
+	}
+}
+
+// quit closes all registered clients
 func (h *hub) quit() {
-	log.Info("Closing all registered clients")
-	for client := range h.clients {
-		client.Close()
-		delete(h.clients, client)
+	h.service.Log().Info("Closing all registered clients")
+	close(h.done)
+	for c := range h.clients {
+		h.remove(c)
+	}
+}
+
+// stats return the current counters of the hub
+func (h *hub) stats() Stats {
+	h.metrics.lock.Lock()
+	broadcast := make(map[string]uint64, len(h.metrics.broadcast))
+	for msgType, count := range h.metrics.broadcast {
+		broadcast[msgType] = count
+	}
+	h.metrics.lock.Unlock()
+	return Stats{
+		Clients:   atomic.LoadInt64(&h.metrics.clients),
+		Sent:      atomic.LoadUint64(&h.metrics.sent),
+		Dropped:   atomic.LoadUint64(&h.metrics.dropped),
+		Coalesced: atomic.LoadUint64(&h.metrics.coalesced),
+		Evicted:   atomic.LoadUint64(&h.metrics.evicted),
+		Broadcast: broadcast,
 	}
-	close(h.register)
-	close(h.close)
 }
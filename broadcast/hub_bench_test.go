@@ -0,0 +1,182 @@
+package broadcast
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// benchMessage is a stats report like the ones sent by the nodes
+var benchMessage = []byte(`{"emit":["stats",{"id":"node-1","stats":{"active":true,"syncing":false,"mining":true,"hashrate":1000000,"peers":25,"gasPrice":1000000000,"uptime":100}}]}`)
+
+// benchSender is a sender that only keeps the id of the last message sent
+type benchSender struct {
+	last   uint64
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newBenchSender() *benchSender {
+	return &benchSender{closed: make(chan struct{})}
+}
+
+func (s *benchSender) send(i item) error {
+	if i.id > atomic.LoadUint64(&s.last) {
+		atomic.StoreUint64(&s.last, i.id)
+	}
+	return nil
+}
+
+func (s *benchSender) receive(handle func(content []byte)) error {
+	<-s.closed
+	return nil
+}
+
+func (s *benchSender) close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *benchSender) addr() string {
+	return "bench"
+}
+
+// benchChannel return a service channel that discards the logs
+func benchChannel() *service.Channel {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	return &service.Channel{
+		Message: make(chan service.Message),
+		Nodes:   service.NewRegistry(service.RejectDuplicate),
+		Logger:  logger,
+	}
+}
+
+// BenchmarkFanOut measures the messages sent to all clients through the hub,
+// from the service channel to the senders of the clients
+func BenchmarkFanOut(b *testing.B) {
+	for _, clients := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprint(clients), func(b *testing.B) {
+			benchmarkFanOut(b, clients)
+		})
+	}
+}
+
+func benchmarkFanOut(b *testing.B, clients int) {
+	channel := benchChannel()
+	server := New(channel, Config{QueueSize: 256, Overflow: DropOldest})
+	defer server.Close()
+	senders := make([]*benchSender, clients)
+	for n := range senders {
+		senders[n] = newBenchSender()
+		c := newClient(senders[n], server.hub.config.QueueSize, server.hub.config.Overflow)
+		if server.register(c) {
+			go server.hub.serve(c)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for n := 0; n < b.N; n++ {
+		channel.Message <- service.Message{Content: benchMessage, Type: message.TypeStats, Node: "node-1"}
+	}
+	// the newest message is never dropped, so every client gets the last one
+	for _, s := range senders {
+		for atomic.LoadUint64(&s.last) < uint64(b.N) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	stats := server.Stats()
+	delivered := float64(b.N*clients) - float64(stats.Dropped)
+	b.ReportMetric(delivered/elapsed.Seconds(), "deliveries/s")
+	b.ReportMetric(float64(stats.Dropped)/float64(b.N), "dropped/op")
+}
+
+// BenchmarkWrite measures writing each message to 100 websocket clients, with
+// a frame prepared once for all of them or built for every client, with and
+// without compression
+func BenchmarkWrite(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		for _, prepare := range []bool{false, true} {
+			name := "raw"
+			if prepare {
+				name = "prepared"
+			}
+			if compress {
+				name += "/compressed"
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkWrite(b, prepare, compress)
+			})
+		}
+	}
+}
+
+func benchmarkWrite(b *testing.B, prepare, compress bool) {
+	const clients = 100
+	upgrader := websocket.Upgrader{EnableCompression: compress}
+	conns := make(chan *websocket.Conn, clients)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	defer server.Close()
+
+	dialer := websocket.Dialer{EnableCompression: compress}
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	senders := make([]*wsSender, clients)
+	for n := range senders {
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		// the dashboard side discards everything it receives
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		senders[n] = &wsSender{conn: <-conns}
+		defer senders[n].close()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i := item{data: benchMessage}
+		if prepare {
+			prepared, err := websocket.NewPreparedMessage(websocket.TextMessage, benchMessage)
+			if err != nil {
+				b.Fatal(err)
+			}
+			i.prepared = prepared
+		}
+		for _, s := range senders {
+			if err := s.send(i); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+)
+
+// Primus is the endpoint used by the eth-netstats frontend to connect
+const Primus string = "/primus/"
+
+// netstatsAction is the envelope of the messages sent to eth-netstats clients
+type netstatsAction struct {
+	Action string      `json:"action"`
+	Data   interface{} `json:"data"`
+}
+
+// netstatsBlock is the block of a node, as expected by the eth-netstats frontend
+type netstatsBlock struct {
+	message.BlockStats
+	Arrived     int64 `json:"arrived"`
+	Received    int64 `json:"received"`
+	Propagation int64 `json:"propagation"`
+}
+
+// netstatsStats are the stats of a node, as expected by the eth-netstats frontend
+type netstatsStats struct {
+	Active         bool          `json:"active"`
+	Mining         bool          `json:"mining"`
+	Syncing        bool          `json:"syncing"`
+	Hashrate       int           `json:"hashrate"`
+	Peers          int           `json:"peers"`
+	GasPrice       int           `json:"gasPrice"`
+	Uptime         int           `json:"uptime"`
+	Latency        int           `json:"latency"`
+	Pending        int           `json:"pending"`
+	Block          netstatsBlock `json:"block"`
+	PropagationAvg int64         `json:"propagationAvg"`
+}
+
+// netstatsNode is a node, as expected by the eth-netstats frontend
+type netstatsNode struct {
+	ID      string           `json:"id"`
+	Info    message.NodeInfo `json:"info"`
+	Stats   netstatsStats    `json:"stats"`
+	History []int64          `json:"history"`
+}
+
+// netstats is the encoder of the protocol used by the eth-netstats frontend,
+// that expects aggregated node state instead of raw node messages
+type netstats struct {
+	service *service.Channel
+
+	// miners is the last leaderboard, sent inside the charts action
+	miners json.RawMessage
+}
+
+// init return the init action with all known nodes
+func (n *netstats) init(nodes []service.Node) []service.Message {
+	all := make([]*netstatsNode, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Hello != nil {
+			all = append(all, n.node(node))
+		}
+	}
+	return untyped(n.actions(netstatsAction{Action: "init", Data: all}))
+}
+
+// encode translates the node message to the equivalent eth-netstats action
+func (n *netstats) encode(content []byte) [][]byte {
+	msg, err := message.Parse(content)
+	if err != nil {
+		return nil
+	}
+	switch msg.Type {
+	case message.TypeNodeEvent:
+		return n.encodeEvent(msg)
+	case message.TypeCharts:
+		return n.encodeCharts(msg)
+	case message.TypeMiners:
+		n.miners = msg.Value
+		return nil
+	case message.TypePropagation:
+		return n.encodePropagation(msg)
+	}
+	value, err := msg.Decode()
+	if err != nil {
+		return nil
+	}
+	switch v := value.(type) {
+	case *message.AuthMessage:
+		node, _ := n.service.Nodes.Get(v.ID)
+		data := n.node(node)
+		data.ID, data.Info, data.Stats.Active = v.ID, v.Info, true
+		return n.actions(netstatsAction{Action: "add", Data: data})
+	case *message.PendingReport:
+		data := map[string]interface{}{"id": v.ID, "pending": v.Stats.Pending}
+		return n.actions(netstatsAction{Action: "pending", Data: data})
+	case *message.StatsReport:
+		node, _ := n.service.Nodes.Get(v.ID)
+		stats := n.node(node).Stats
+		stats.Active, stats.Mining, stats.Syncing = v.Stats.Active, v.Stats.Mining, v.Stats.Syncing
+		stats.Hashrate, stats.Peers, stats.GasPrice, stats.Uptime = v.Stats.Hashrate, v.Stats.Peers, v.Stats.GasPrice, v.Stats.Uptime
+		data := map[string]interface{}{"id": v.ID, "stats": stats}
+		// the stats action only refreshes the basic stats in the frontend,
+		// the update action replaces all of them, like block and pending
+		return n.actions(
+			netstatsAction{Action: "stats", Data: data},
+			netstatsAction{Action: "update", Data: data},
+		)
+	case *message.LatencyReport:
+		latency, _ := strconv.Atoi(v.Latency)
+		data := map[string]interface{}{"id": v.ID, "latency": latency}
+		return n.actions(netstatsAction{Action: "latency", Data: data})
+	}
+	return nil
+}
+
+// encodeCharts return the charts action, including the last miners leaderboard
+func (n *netstats) encodeCharts(msg *message.Message) [][]byte {
+	var charts map[string]json.RawMessage
+	if err := json.Unmarshal(msg.Value, &charts); err != nil {
+		return nil
+	}
+	charts["miners"] = json.RawMessage("[]")
+	if n.miners != nil {
+		charts["miners"] = n.miners
+	}
+	return n.actions(netstatsAction{Action: "charts", Data: charts})
+}
+
+// encodePropagation return the block action of the node. The block action is
+// sent after the propagation of the block is known, instead of when the node
+// reports the block
+func (n *netstats) encodePropagation(msg *message.Message) [][]byte {
+	var report message.PropagationReport
+	if err := json.Unmarshal(msg.Value, &report); err != nil {
+		return nil
+	}
+	node, ok := n.service.Nodes.Get(report.ID)
+	if !ok {
+		return nil
+	}
+	stats := n.node(node).Stats
+	if stats.Block.Hash != report.Hash {
+		// the node already reported a newer block
+		return nil
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	stats.Block.Arrived, stats.Block.Received = now, now
+	data := map[string]interface{}{
+		"id":             report.ID,
+		"block":          stats.Block,
+		"propagationAvg": report.PropagationAvg,
+		"history":        report.History,
+	}
+	return n.actions(netstatsAction{Action: "block", Data: data})
+}
+
+// encodeEvent return the inactive action when a node disconnects
+func (n *netstats) encodeEvent(msg *message.Message) [][]byte {
+	var event message.NodeEvent
+	if err := json.Unmarshal(msg.Value, &event); err != nil || event.Event != message.EventDisconnected {
+		return nil
+	}
+	node, ok := n.service.Nodes.Get(event.ID)
+	if !ok {
+		return nil
+	}
+	stats := n.node(node).Stats
+	stats.Active = false
+	data := map[string]interface{}{"id": node.ID, "stats": stats}
+	return n.actions(netstatsAction{Action: "inactive", Data: data})
+}
+
+// refresh return the primus heartbeat, without it the frontend reconnects
+func (n *netstats) refresh(nodes []service.Node) []service.Message {
+	ping := fmt.Sprintf("primus::ping::%d", time.Now().UnixNano()/int64(time.Millisecond))
+	content, _ := json.Marshal(ping)
+	return untyped([][]byte{content})
+}
+
+// node builds the eth-netstats node from the latest messages of a registered node
+func (n *netstats) node(node service.Node) *netstatsNode {
+	result := &netstatsNode{ID: node.ID, History: []int64{}}
+	result.Stats.Active = node.Active
+	for msgType, content := range node.Latest {
+		msg, err := message.Parse(content)
+		if err != nil {
+			continue
+		}
+		value, err := msg.Decode()
+		if err != nil {
+			continue
+		}
+		switch v := value.(type) {
+		case *message.BlockReport:
+			result.Stats.Block = netstatsBlock{BlockStats: v.Block}
+		case *message.PendingReport:
+			result.Stats.Pending = v.Stats.Pending
+		case *message.StatsReport:
+			result.Stats.Mining, result.Stats.Syncing = v.Stats.Mining, v.Stats.Syncing
+			result.Stats.Hashrate, result.Stats.Peers = v.Stats.Hashrate, v.Stats.Peers
+			result.Stats.GasPrice, result.Stats.Uptime = v.Stats.GasPrice, v.Stats.Uptime
+		case *message.LatencyReport:
+			result.Stats.Latency, _ = strconv.Atoi(v.Latency)
+		default:
+			n.service.Log().Debugf("Ignoring %s message of node[%s]", msgType, node.ID)
+		}
+	}
+	// propagation is emitted by this server, so it isn't decoded like node messages
+	if content, ok := node.Latest[message.TypePropagation]; ok {
+		if msg, err := message.Parse(content); err == nil {
+			var report message.PropagationReport
+			if json.Unmarshal(msg.Value, &report) == nil && report.Hash == result.Stats.Block.Hash {
+				result.Stats.Block.Propagation = report.Propagation
+				result.Stats.PropagationAvg = report.PropagationAvg
+				result.History = report.History
+			}
+		}
+	}
+	if msg, err := message.Parse(node.Hello); err == nil {
+		if value, err := msg.Decode(); err == nil {
+			result.Info = value.(*message.AuthMessage).Info
+		}
+	}
+	return result
+}
+
+// actions encodes the given actions
+func (n *netstats) actions(actions ...netstatsAction) [][]byte {
+	messages := make([][]byte, 0, len(actions))
+	for _, action := range actions {
+		content, err := json.Marshal(action)
+		if err != nil {
+			n.service.Log().Warningf("Can't encode %s action, error: %s", action.Action, err)
+			continue
+		}
+		messages = append(messages, content)
+	}
+	return messages
+}
+
+// untyped return the messages of the given contents, without type nor node
+// since they aren't about a single node message
+func untyped(contents [][]byte) []service.Message {
+	messages := make([]service.Message, 0, len(contents))
+	for _, content := range contents {
+		messages = append(messages, service.Message{Content: content})
+	}
+	return messages
+}
@@ -0,0 +1,116 @@
+package broadcast
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+)
+
+// Protocol is the wire format used to send messages to the dashboard clients
+type Protocol int
+
+const (
+	// RawProtocol sends the messages emitted by the nodes untouched
+	RawProtocol Protocol = iota
+	// NetstatsProtocol speaks the format of the eth-netstats web frontend
+	NetstatsProtocol
+)
+
+// ParseProtocol return the protocol with the given name: raw or netstats
+func ParseProtocol(name string) (Protocol, error) {
+	switch name {
+	case "raw":
+		return RawProtocol, nil
+	case "netstats":
+		return NetstatsProtocol, nil
+	}
+	return RawProtocol, fmt.Errorf("unknown client protocol %q", name)
+}
+
+// encoder translates the messages emitted by the nodes to the messages sent to
+// the clients. Encoders are only used from the hub goroutine
+type encoder interface {
+	// init return the messages sent to a new client with the state of the nodes
+	init(nodes []service.Node) []service.Message
+
+	// encode return the messages sent to the clients for a node message. They
+	// have the type and node of the encoded message
+	encode(msg []byte) [][]byte
+
+	// refresh return the messages periodically sent to all clients
+	refresh(nodes []service.Node) []service.Message
+}
+
+// newEncoder creates the encoder of the given protocol
+func newEncoder(protocol Protocol, service *service.Channel) encoder {
+	if protocol == NetstatsProtocol {
+		return &netstats{service: service}
+	}
+	return raw{service: service}
+}
+
+// snapshotTypes are the messages of each node sent to new clients, in order
+var snapshotTypes = []string{
+	message.TypeHistory,
+	message.TypeBlock,
+	message.TypePropagation,
+	message.TypeStats,
+	message.TypePending,
+	message.TypeLatency,
+}
+
+// raw is the encoder of the raw protocol
+type raw struct {
+	service *service.Channel
+}
+
+// init return the hello and the latest messages of every known node. Inactive
+// nodes are followed by an inactive event
+func (e raw) init(nodes []service.Node) []service.Message {
+	var messages []service.Message
+	for _, node := range nodes {
+		if node.Hello == nil {
+			continue
+		}
+		messages = append(messages, service.Message{Content: node.Hello, Type: message.TypeHello, Node: node.ID})
+		for _, msgType := range snapshotTypes {
+			if content, ok := node.Latest[msgType]; ok {
+				messages = append(messages, service.Message{Content: content, Type: msgType, Node: node.ID})
+			}
+		}
+		if node.Active {
+			continue
+		}
+		// let the client know the node isn't reporting anymore
+		event := &message.NodeEvent{
+			ID:    node.ID,
+			Event: message.EventInactive,
+			Time:  node.LastSeen.UnixNano() / int64(time.Millisecond),
+		}
+		msg, err := message.New(message.TypeNodeEvent, event)
+		if err != nil {
+			e.service.Log().Warningf("Can't create inactive event for node[%s], error: %s", node.ID, err)
+			continue
+		}
+		messages = append(messages, service.Message{Content: msg.Content, Type: msg.Type, Node: node.ID})
+	}
+	return messages
+}
+
+// encode return the message untouched
+func (raw) encode(msg []byte) [][]byte {
+	return [][]byte{msg}
+}
+
+// refresh return the hello message of every connected node
+func (raw) refresh(nodes []service.Node) []service.Message {
+	var messages []service.Message
+	for _, node := range nodes {
+		if node.Active && node.Hello != nil {
+			messages = append(messages, service.Message{Content: node.Hello, Type: message.TypeHello, Node: node.ID})
+		}
+	}
+	return messages
+}
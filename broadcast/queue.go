@@ -0,0 +1,163 @@
+package broadcast
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// OverflowPolicy is the behaviour of the hub when the queue of a client is full
+type OverflowPolicy int
+
+const (
+	// DropOldest drops the oldest queued message to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// Coalesce replaces the queued message of the same type and node with the
+	// new one. If there is no such message, the oldest one is dropped
+	Coalesce
+	// Disconnect closes the connection with the client
+	Disconnect
+)
+
+// ParseOverflowPolicy return the policy with the given name: drop-oldest,
+// coalesce or disconnect
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "coalesce":
+		return Coalesce, nil
+	case "disconnect":
+		return Disconnect, nil
+	}
+	return DropOldest, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// pushResult is the outcome of pushing a message to a queue
+type pushResult int
+
+const (
+	pushed pushResult = iota
+	droppedOldest
+	coalesced
+	overflowed
+	queueClosed
+)
+
+// item is a message waiting to be sent to a client
+type item struct {
+	// key identifies the type and node of the message, so newer messages can
+	// replace older ones. Empty if the message can't be coalesced
+	key  string
+	data []byte
+
+	// id is the sequence number of the message, zero for the messages sent
+	// only to a client, like the initial state. msgType and node are the type
+	// and node id of the message, used to filter it
+	id      uint64
+	msgType string
+	node    string
+
+	// prepared is the websocket frame of the message, built once and shared
+	// by all clients. If nil, the frame is built when writing the message
+	prepared *websocket.PreparedMessage
+}
+
+// queue is a bounded queue of messages. Pushing never blocks, the overflow
+// policy decides what to do when the queue is full
+type queue struct {
+	lock   sync.Mutex
+	items  []item
+	size   int
+	policy OverflowPolicy
+	closed bool
+
+	// ready receives a signal when there are new items in the queue
+	ready chan struct{}
+}
+
+// newQueue creates a new queue with the given capacity and overflow policy
+func newQueue(size int, policy OverflowPolicy) *queue {
+	return &queue{
+		items:  make([]item, 0, size),
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push adds the item to the queue, applying the overflow policy if the queue is full
+func (q *queue) push(i item) pushResult {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return queueClosed
+	}
+	result := pushed
+	if len(q.items) >= q.size {
+		switch q.policy {
+		case Disconnect:
+			return overflowed
+		case Coalesce:
+			if i.key != "" {
+				for n := range q.items {
+					if q.items[n].key == i.key {
+						q.items[n] = i
+						return coalesced
+					}
+				}
+			}
+			fallthrough
+		case DropOldest:
+			q.items = append(q.items[:0], q.items[1:]...)
+			result = droppedOldest
+		}
+	}
+	q.items = append(q.items, i)
+	q.signal()
+	return result
+}
+
+// pushAll adds all the items to the queue ignoring its capacity
+func (q *queue) pushAll(items []item) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.items = append(q.items, items...)
+	q.signal()
+}
+
+// pop removes and return all queued items. The given slice, already written
+// by the caller, is reused to queue the next items, so popping doesn't allocate
+func (q *queue) pop(spare []item) []item {
+	for n := range spare {
+		spare[n] = item{}
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	items := q.items
+	if q.closed {
+		return items
+	}
+	q.items = spare[:0]
+	return items
+}
+
+// close closes the queue, so no more items can be pushed
+func (q *queue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.items = nil
+}
+
+// signal notifies the writer there are new items. Must be called holding the lock
+func (q *queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,126 @@
+package broadcast
+
+import (
+	"reflect"
+	"testing"
+)
+
+// ids return the ids of the items
+func ids(items []item) []uint64 {
+	result := make([]uint64, 0, len(items))
+	for _, i := range items {
+		result = append(result, i.id)
+	}
+	return result
+}
+
+func TestQueuePush(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  OverflowPolicy
+		keys    []string
+		results []pushResult
+		ids     []uint64
+	}{
+		{
+			name:    "drop oldest",
+			policy:  DropOldest,
+			keys:    []string{"a", "b", "c", "a", "d"},
+			results: []pushResult{pushed, pushed, pushed, droppedOldest, droppedOldest},
+			ids:     []uint64{3, 4, 5},
+		},
+		{
+			name:    "coalesce same key",
+			policy:  Coalesce,
+			keys:    []string{"a", "b", "c", "b", "a"},
+			results: []pushResult{pushed, pushed, pushed, coalesced, coalesced},
+			ids:     []uint64{5, 4, 3},
+		},
+		{
+			name:    "coalesce without same key drops oldest",
+			policy:  Coalesce,
+			keys:    []string{"a", "b", "c", "d"},
+			results: []pushResult{pushed, pushed, pushed, droppedOldest},
+			ids:     []uint64{2, 3, 4},
+		},
+		{
+			name:    "coalesce without key drops oldest",
+			policy:  Coalesce,
+			keys:    []string{"", "", "", ""},
+			results: []pushResult{pushed, pushed, pushed, droppedOldest},
+			ids:     []uint64{2, 3, 4},
+		},
+		{
+			name:    "disconnect",
+			policy:  Disconnect,
+			keys:    []string{"a", "b", "c", "a"},
+			results: []pushResult{pushed, pushed, pushed, overflowed},
+			ids:     []uint64{1, 2, 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newQueue(3, test.policy)
+			for n, key := range test.keys {
+				if result := q.push(item{key: key, id: uint64(n + 1)}); result != test.results[n] {
+					t.Errorf("push %d result = %d, want %d", n+1, result, test.results[n])
+				}
+			}
+			if got := ids(q.pop(nil)); !reflect.DeepEqual(got, test.ids) {
+				t.Errorf("queued ids = %v, want %v", got, test.ids)
+			}
+		})
+	}
+}
+
+func TestQueueClosed(t *testing.T) {
+	q := newQueue(3, DropOldest)
+	q.push(item{id: 1})
+	q.close()
+	if result := q.push(item{id: 2}); result != queueClosed {
+		t.Errorf("push to a closed queue result = %d, want %d", result, queueClosed)
+	}
+	q.pushAll([]item{{id: 3}})
+	if items := q.pop(nil); len(items) != 0 {
+		t.Errorf("closed queue popped %v", ids(items))
+	}
+}
+
+func TestQueuePushAll(t *testing.T) {
+	q := newQueue(2, Disconnect)
+	q.pushAll([]item{{id: 1}, {id: 2}, {id: 3}})
+	if got := ids(q.pop(nil)); !reflect.DeepEqual(got, []uint64{1, 2, 3}) {
+		t.Errorf("queued ids = %v, want [1 2 3]", got)
+	}
+}
+
+func TestQueuePopReusesSpare(t *testing.T) {
+	q := newQueue(4, DropOldest)
+	q.push(item{id: 1, data: []byte("1")})
+	q.push(item{id: 2, data: []byte("2")})
+	first := q.pop(nil)
+	if got := ids(first); !reflect.DeepEqual(got, []uint64{1, 2}) {
+		t.Fatalf("popped ids = %v, want [1 2]", got)
+	}
+
+	q.push(item{id: 3})
+	second := q.pop(first)
+	if got := ids(second); !reflect.DeepEqual(got, []uint64{3}) {
+		t.Fatalf("popped ids = %v, want [3]", got)
+	}
+	// the written items are released, and their slice queues the next ones
+	if first[1].data != nil {
+		t.Error("spare items not cleared before reusing them")
+	}
+	q.push(item{id: 4})
+	if second[0].id != 3 {
+		t.Errorf("popped item overwritten by a push, id = %d", second[0].id)
+	}
+	third := q.pop(second)
+	if got := ids(third); !reflect.DeepEqual(got, []uint64{4}) {
+		t.Fatalf("popped ids = %v, want [4]", got)
+	}
+	if &third[0] != &first[0] {
+		t.Error("spare slice not reused to queue the next items")
+	}
+}
@@ -3,35 +3,65 @@ package broadcast
 import (
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/eskoltech/ethstats-server/service"
 	"github.com/gorilla/websocket"
-	log "github.com/sirupsen/logrus"
 )
 
 // Root is the home endpoint where hub are registered to receive node updates
 const Root string = "/"
 
-// upgradeConnection upgrade only HTTP request to the / endpoint
+// upgradeConnection upgrade only HTTP request to the / and /primus/ endpoints
 var upgradeConnection = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
-		return strings.Compare(r.RequestURI, Root) == 0
+		return strings.Compare(r.RequestURI, Root) == 0 || strings.HasPrefix(r.URL.Path, Primus)
 	},
 }
 
+// Config contains the settings used by the broadcast server
+type Config struct {
+	// QueueSize is the maximum number of messages waiting to be sent to a client
+	QueueSize int
+
+	// Overflow is the policy applied when the queue of a client is full
+	Overflow OverflowPolicy
+
+	// WriteTimeout is the maximum time to write a message to a client. If
+	// zero, writes never time out
+	WriteTimeout time.Duration
+
+	// Protocol is the wire format used to talk to the clients
+	Protocol Protocol
+
+	// Backlog is the number of messages kept so event stream clients can
+	// resume after reconnecting. If zero, clients always get the full state
+	Backlog int
+}
+
 // Server is the responsible to send node state to registered hub
 type Server struct {
 	hub *hub
 }
 
 // New creates a new Server struct with the required service
-func New(service *service.Channel) *Server {
-	defer func() { log.Info("Server started successfully") }()
+func New(service *service.Channel, config Config) *Server {
+	defer func() { service.Log().Info("Server started successfully") }()
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1
+	}
 	hub := &hub{
-		register: make(chan *websocket.Conn),
-		close:    make(chan interface{}),
-		clients:  make(map[*websocket.Conn]bool),
-		service:  service,
+		register:   make(chan *client),
+		unregister: make(chan *client),
+		commands:   make(chan command),
+		close:      make(chan interface{}),
+		done:       make(chan struct{}),
+		clients:    make(map[*client]bool),
+		service:    service,
+		config:     config,
+		encoder:    newEncoder(config.Protocol, service),
+		metrics:    &metrics{broadcast: make(map[string]uint64)},
+		backlog:    newBacklog(config.Backlog),
 	}
 	go hub.loop()
 	return &Server{hub: hub}
@@ -39,18 +69,42 @@ func New(service *service.Channel) *Server {
 
 // Close this server and all registered client connections
 func (s *Server) Close() {
-	log.Info("Prepared to close all client connections")
-	s.hub.close <- "close"
+	s.hub.service.Log().Info("Prepared to close all client connections")
+	select {
+	case s.hub.close <- "close":
+	case <-s.hub.done:
+	}
 }
 
 // HandleRequest handle all request from hub that are not Ethereum nodes
 func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	clientConn, err := upgradeConnection.Upgrade(w, r, nil)
 	if err != nil {
-		log.Errorf("Error trying to establish communication with client (addr=%s, host=%s, URI=%s), %s",
+		s.hub.service.Log().Errorf("Error trying to establish communication with client (addr=%s, host=%s, URI=%s), %s",
 			r.RemoteAddr, r.Host, r.RequestURI, err)
 		return
 	}
-	log.Infof("Connected new client! (host=%s)", r.Host)
-	s.hub.register <- clientConn
+	s.hub.service.Log().Infof("Connected new client! (host=%s)", r.Host)
+	sender := &wsSender{conn: clientConn, timeout: s.hub.config.WriteTimeout}
+	c := newClient(sender, s.hub.config.QueueSize, s.hub.config.Overflow)
+	if s.register(c) {
+		go s.hub.serve(c)
+	}
+}
+
+// register registers the client in the hub. If the hub is closed, the client
+// is closed and false is returned
+func (s *Server) register(c *client) bool {
+	select {
+	case s.hub.register <- c:
+		return true
+	case <-s.hub.done:
+		c.close()
+		return false
+	}
+}
+
+// Stats return the counters of the messages sent to clients
+func (s *Server) Stats() Stats {
+	return s.hub.stats()
 }
@@ -0,0 +1,107 @@
+package broadcast
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Events is the endpoint where clients receive the messages as server-sent events
+const Events string = "/events"
+
+// errClientGone is returned when an event stream client goes away
+var errClientGone = errors.New("client went away")
+
+// sseSender sends the messages to a client as server-sent events. Each event
+// has the message type as name and, if the message was sent to all clients,
+// its sequence number as id
+type sseSender struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	gone    <-chan struct{}
+	closed  chan struct{}
+	remote  string
+}
+
+// send writes the item as an event and flushes it to the client
+func (s *sseSender) send(i item) error {
+	var event bytes.Buffer
+	if i.id > 0 {
+		event.WriteString("id: " + strconv.FormatUint(i.id, 10) + "\n")
+	}
+	if i.msgType != "" {
+		event.WriteString("event: " + i.msgType + "\n")
+	}
+	for _, line := range bytes.Split(i.data, []byte("\n")) {
+		event.WriteString("data: ")
+		event.Write(line)
+		event.WriteByte('\n')
+	}
+	event.WriteByte('\n')
+	if _, err := s.w.Write(event.Bytes()); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// receive blocks until the client goes away or the sender is closed. Event
+// stream clients can't send messages
+func (s *sseSender) receive(handle func(content []byte)) error {
+	select {
+	case <-s.gone:
+		return errClientGone
+	case <-s.closed:
+		return nil
+	}
+}
+
+// close stops waiting for the client, the stream ends when the request
+// handler returns
+func (s *sseSender) close() error {
+	close(s.closed)
+	return nil
+}
+
+// addr return the remote address of the client
+func (s *sseSender) addr() string {
+	return s.remote
+}
+
+// HandleEvents streams the messages sent to the clients as server-sent
+// events. Clients can resume a previous stream using the Last-Event-ID
+// header, and select the messages they receive with the query parameters
+// accepted by ParseFilter
+func (s *Server) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	s.hub.service.Log().Infof("Connected new event stream client! (host=%s)", r.Host)
+
+	sender := &sseSender{
+		w:       w,
+		flusher: flusher,
+		gone:    r.Context().Done(),
+		closed:  make(chan struct{}),
+		remote:  r.RemoteAddr,
+	}
+	c := newClient(sender, s.hub.config.QueueSize, s.hub.config.Overflow)
+	c.filter = ParseFilter(r.URL.Query())
+	if id, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		c.resume, c.resuming = id, true
+	}
+	// the stream can only be written until this handler returns, so the
+	// messages are written from this goroutine
+	if s.register(c) {
+		s.hub.serve(c)
+	}
+}
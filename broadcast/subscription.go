@@ -0,0 +1,49 @@
+package broadcast
+
+import (
+	"encoding/json"
+
+	"github.com/eskoltech/ethstats-server/message"
+)
+
+// command is a subscribe or unsubscribe command sent by a client
+type command struct {
+	client    *client
+	subscribe bool
+	filter    *Filter
+}
+
+// handle parses the message sent by a client and, if it's a command, asks the
+// hub to apply it. Other messages are ignored
+func (h *hub) handle(c *client, content []byte) {
+	msg, err := message.Parse(content)
+	if err != nil || (msg.Type != message.TypeSubscribe && msg.Type != message.TypeUnsubscribe) {
+		return
+	}
+	var subscription message.Subscription
+	if err := json.Unmarshal(msg.Value, &subscription); err != nil {
+		h.service.Log().Warningf("Invalid %s command from client %s, %s", msg.Type, c.sender.addr(), err)
+		return
+	}
+	cmd := command{client: c, subscribe: msg.Type == message.TypeSubscribe, filter: newFilter(subscription)}
+	select {
+	case h.commands <- cmd:
+	case <-h.done:
+	}
+}
+
+// apply updates the filter of the client. After subscribing, the state of the
+// nodes is sent again, so the client has the state of the new nodes
+func (h *hub) apply(cmd command) {
+	c := cmd.client
+	if !h.clients[c] {
+		return
+	}
+	if !cmd.subscribe {
+		c.filter = c.filter.unsubscribe(cmd.filter)
+		return
+	}
+	c.filter = c.filter.subscribe(cmd.filter)
+	c.resuming = false
+	h.sendInit(c)
+}
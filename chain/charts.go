@@ -0,0 +1,58 @@
+package chain
+
+// unclesBin is the number of blocks grouped in each uncle count of the charts
+const unclesBin int = 25
+
+// Charts are the stats of the latest blocks, using the same fields that the
+// eth-netstats frontend expects
+type Charts struct {
+	Height       []uint64  `json:"height"`
+	BlockTime    []float64 `json:"blocktime"`
+	AvgBlockTime float64   `json:"avgBlocktime"`
+	Difficulty   []string  `json:"difficulty"`
+	Uncles       []int     `json:"uncles"`
+	UncleCount   []int     `json:"uncleCount"`
+	Transactions []int     `json:"transactions"`
+	GasSpending  []uint64  `json:"gasSpending"`
+	GasLimit     []uint64  `json:"gasLimit"`
+	AvgHashrate  int       `json:"avgHashrate"`
+
+	Propagation PropagationChart `json:"propagation"`
+}
+
+// Charts return the charts of the blocks in the window
+func (e *Engine) Charts() Charts {
+	network := e.Network()
+	e.lock.RLock()
+	blocks := e.window()
+	propagation := e.propagationChart()
+	e.lock.RUnlock()
+
+	charts := Charts{
+		Height:       make([]uint64, 0, len(blocks)),
+		BlockTime:    make([]float64, 0, len(blocks)),
+		Difficulty:   make([]string, 0, len(blocks)),
+		Uncles:       make([]int, 0, len(blocks)),
+		Transactions: make([]int, 0, len(blocks)),
+		GasSpending:  make([]uint64, 0, len(blocks)),
+		GasLimit:     make([]uint64, 0, len(blocks)),
+		UncleCount:   []int{},
+		AvgBlockTime: network.AvgBlockTime,
+		AvgHashrate:  network.Hashrate,
+		Propagation:  propagation,
+	}
+	for n, block := range blocks {
+		charts.Height = append(charts.Height, block.Number)
+		charts.BlockTime = append(charts.BlockTime, block.BlockTime)
+		charts.Difficulty = append(charts.Difficulty, block.Difficulty)
+		charts.Uncles = append(charts.Uncles, len(block.Uncles))
+		charts.Transactions = append(charts.Transactions, len(block.Transactions))
+		charts.GasSpending = append(charts.GasSpending, block.GasUsed)
+		charts.GasLimit = append(charts.GasLimit, block.GasLimit)
+		if n%unclesBin == 0 {
+			charts.UncleCount = append(charts.UncleCount, 0)
+		}
+		charts.UncleCount[len(charts.UncleCount)-1] += len(block.Uncles)
+	}
+	return charts
+}
@@ -0,0 +1,389 @@
+package chain
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+)
+
+// Config contains the settings used by the aggregation engine
+type Config struct {
+	// Window is the number of blocks, counting back from the best one, used to
+	// compute the network stats
+	Window int
+
+	// Interval is the time between charts updates sent to the clients
+	Interval time.Duration
+
+	// StatsTTL is the time the stats reported by a node are taken into
+	// account. Nodes that don't report in this time are ignored. The stats of
+	// a node are always removed when it disconnects
+	StatsTTL time.Duration
+}
+
+// Block is a block known by the engine
+type Block struct {
+	message.BlockStats
+
+	// Arrived is the first time a node reported the block
+	Arrived time.Time `json:"arrived"`
+
+	// BlockTime is the time since the parent block, in seconds. Zero if the
+	// parent block is unknown
+	BlockTime float64 `json:"blockTime"`
+}
+
+// Network contains the stats of the whole network
+type Network struct {
+	BestBlock        uint64  `json:"bestBlock"`
+	BestHash         string  `json:"bestHash"`
+	LastBlockTime    float64 `json:"lastBlockTime"`
+	AvgBlockTime     float64 `json:"avgBlockTime"`
+	Difficulty       string  `json:"difficulty"`
+	TotalDifficulty  string  `json:"totalDifficulty"`
+	GasLimit         uint64  `json:"gasLimit"`
+	AvgGasUsed       float64 `json:"avgGasUsed"`
+	Transactions     int     `json:"transactions"`
+	AvgTransactions  float64 `json:"avgTransactions"`
+	UncleRate        float64 `json:"uncleRate"`
+	ActiveNodes      int     `json:"activeNodes"`
+	MiningNodes      int     `json:"miningNodes"`
+	SyncingNodes     int     `json:"syncingNodes"`
+	Hashrate         int     `json:"hashrate"`
+	AvgPeers         float64 `json:"avgPeers"`
+	BlocksInWindow   int     `json:"blocksInWindow"`
+	LastBlockArrived int64   `json:"lastBlockArrived"`
+}
+
+// nodeStats are the last stats reported by a node
+type nodeStats struct {
+	stats   message.NodeStats
+	updated time.Time
+}
+
+// Engine aggregates the blocks and stats reported by all nodes to compute the
+// state of the whole network. It's safe for concurrent use
+type Engine struct {
+	lock    sync.RWMutex
+	config  Config
+	blocks  map[string]*Block
+	numbers map[uint64]string
+	best    *Block
+	nodes   map[string]nodeStats
+
+	// delays contains the propagation delays of each block, and nodeDelays
+	// the latest delays of each node
+	delays     map[string][]int64
+	nodeDelays map[string][]int64
+
+	// version changes every time the engine state changes, so charts are
+	// only published when there is something new
+	version   uint64
+	published uint64
+
+	service *service.Channel
+	changes <-chan service.Change
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// New creates a new Engine and starts publishing charts updates to the service clients
+func New(config Config, service *service.Channel) *Engine {
+	defer func() { service.Log().Info("Chain aggregation engine started successfully") }()
+	if config.Window <= 0 {
+		config.Window = 1
+	}
+	e := &Engine{
+		config:     config,
+		blocks:     make(map[string]*Block),
+		numbers:    make(map[uint64]string),
+		nodes:      make(map[string]nodeStats),
+		delays:     make(map[string][]int64),
+		nodeDelays: make(map[string][]int64),
+		service:    service,
+		changes:    service.Nodes.Watch(64),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// Close stops publishing charts updates and watching the nodes
+func (e *Engine) Close() {
+	close(e.quit)
+	<-e.done
+}
+
+// Consume processes the blocks and stats reported by the nodes
+func (e *Engine) Consume(id string, value interface{}, received time.Time) {
+	switch v := value.(type) {
+	case *message.BlockReport:
+		e.AddBlock(v.Block, received)
+		e.propagate(id, v.Block, received)
+	case *message.HistoryReport:
+		for _, block := range v.History {
+			e.AddBlock(block, received)
+		}
+	case *message.StatsReport:
+		e.lock.Lock()
+		e.nodes[id] = nodeStats{stats: v.Stats, updated: received}
+		e.version++
+		e.lock.Unlock()
+	}
+}
+
+// Remove forgets the stats of a node, i.e. when it disconnects
+func (e *Engine) Remove(id string) {
+	e.lock.Lock()
+	if _, ok := e.nodes[id]; ok {
+		delete(e.nodes, id)
+		e.version++
+	}
+	e.lock.Unlock()
+}
+
+// AddBlock adds a reported block to the engine. Blocks already known are ignored
+func (e *Engine) AddBlock(stats message.BlockStats, received time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if _, ok := e.blocks[stats.Hash]; ok {
+		return
+	}
+	if e.best != nil && stats.Number+uint64(e.config.Window) <= e.best.Number {
+		// too old to be part of the window
+		return
+	}
+	block := &Block{BlockStats: stats, Arrived: received}
+	e.blocks[stats.Hash] = block
+	if parent, ok := e.blocks[stats.ParentHash]; ok && stats.Timestamp >= parent.Timestamp {
+		block.BlockTime = float64(stats.Timestamp - parent.Timestamp)
+	}
+	// blocks requested to fill the history usually arrive after their children
+	if child, ok := e.blocks[e.numbers[stats.Number+1]]; ok && child.ParentHash == stats.Hash && child.Timestamp >= stats.Timestamp {
+		child.BlockTime = float64(child.Timestamp - stats.Timestamp)
+	}
+	// the block at each height is the one with the highest total difficulty
+	if current, ok := e.blocks[e.numbers[stats.Number]]; !ok || heavier(block, current) {
+		e.numbers[stats.Number] = stats.Hash
+	}
+	if e.best == nil || heavier(block, e.best) {
+		e.best = block
+		e.prune()
+	}
+	e.version++
+}
+
+// prune removes the blocks out of the window. Must be called holding the lock
+func (e *Engine) prune() {
+	if e.best.Number < uint64(e.config.Window) {
+		return
+	}
+	oldest := e.best.Number - uint64(e.config.Window) + 1
+	for hash, block := range e.blocks {
+		if block.Number < oldest {
+			delete(e.blocks, hash)
+			delete(e.delays, hash)
+		}
+	}
+	for number := range e.numbers {
+		if number < oldest {
+			delete(e.numbers, number)
+		}
+	}
+}
+
+// Best return the best known block
+func (e *Engine) Best() (Block, bool) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.best == nil {
+		return Block{}, false
+	}
+	return *e.best, true
+}
+
+// Block return the known block with the given number
+func (e *Engine) Block(number uint64) (Block, bool) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	block, ok := e.blocks[e.numbers[number]]
+	if !ok {
+		return Block{}, false
+	}
+	return *block, true
+}
+
+// Missing return up to limit block numbers of the window that aren't known,
+// counting back from the given head, sorted by number. If head is zero or
+// higher than the best known block, the best known block is used
+func (e *Engine) Missing(head uint64, limit int) []uint64 {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.best == nil || limit <= 0 {
+		return nil
+	}
+	if head == 0 || head > e.best.Number {
+		head = e.best.Number
+	}
+	var oldest uint64
+	if e.best.Number >= uint64(e.config.Window) {
+		oldest = e.best.Number - uint64(e.config.Window) + 1
+	}
+	var missing []uint64
+	for number := head; number >= oldest && len(missing) < limit; number-- {
+		if _, ok := e.numbers[number]; !ok {
+			missing = append(missing, number)
+		}
+		if number == 0 {
+			break
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	return missing
+}
+
+// Blocks return the known blocks in the window, sorted by number
+func (e *Engine) Blocks() []Block {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.window()
+}
+
+// window return the block of each height in the window sorted by number. Must
+// be called holding the lock
+func (e *Engine) window() []Block {
+	blocks := make([]Block, 0, len(e.numbers))
+	for _, hash := range e.numbers {
+		if block, ok := e.blocks[hash]; ok {
+			blocks = append(blocks, *block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Number < blocks[j].Number })
+	return blocks
+}
+
+// Network return the current stats of the whole network
+func (e *Engine) Network() Network {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	var network Network
+	blocks := e.window()
+	network.BlocksInWindow = len(blocks)
+	if e.best != nil {
+		network.BestBlock = e.best.Number
+		network.BestHash = e.best.Hash
+		network.LastBlockTime = e.best.BlockTime
+		network.Difficulty = e.best.Difficulty
+		network.TotalDifficulty = e.best.TotalDifficulty
+		network.GasLimit = e.best.GasLimit
+		network.Transactions = len(e.best.Transactions)
+		network.LastBlockArrived = millis(e.best.Arrived)
+	}
+	var blockTimes, gasUsed, txs, uncles float64
+	timed := 0
+	for _, block := range blocks {
+		if block.BlockTime > 0 {
+			blockTimes += block.BlockTime
+			timed++
+		}
+		gasUsed += float64(block.GasUsed)
+		txs += float64(len(block.Transactions))
+		uncles += float64(len(block.Uncles))
+	}
+	if timed > 0 {
+		network.AvgBlockTime = blockTimes / float64(timed)
+	}
+	if len(blocks) > 0 {
+		network.AvgGasUsed = gasUsed / float64(len(blocks))
+		network.AvgTransactions = txs / float64(len(blocks))
+		network.UncleRate = uncles / float64(len(blocks))
+	}
+	var peers float64
+	for _, node := range e.activeNodes() {
+		network.ActiveNodes++
+		peers += float64(node.Peers)
+		network.Hashrate += node.Hashrate
+		if node.Mining {
+			network.MiningNodes++
+		}
+		if node.Syncing {
+			network.SyncingNodes++
+		}
+	}
+	if network.ActiveNodes > 0 {
+		network.AvgPeers = peers / float64(network.ActiveNodes)
+	}
+	return network
+}
+
+// activeNodes return the stats of the nodes that reported recently. Must be
+// called holding the lock
+func (e *Engine) activeNodes() []message.NodeStats {
+	var active []message.NodeStats
+	for _, node := range e.nodes {
+		if e.config.StatsTTL > 0 && time.Since(node.updated) > e.config.StatsTTL {
+			continue
+		}
+		active = append(active, node.stats)
+	}
+	return active
+}
+
+// loop publishes the charts every interval, if the engine state changed, and
+// removes the stats of the nodes that disconnect
+func (e *Engine) loop() {
+	defer close(e.done)
+	var publish <-chan time.Time
+	if e.config.Interval > 0 {
+		ticker := time.NewTicker(e.config.Interval)
+		defer ticker.Stop()
+		publish = ticker.C
+	}
+	for {
+		select {
+		case <-e.quit:
+			return
+		case change := <-e.changes:
+			if change.Type != service.NodeConnected {
+				e.Remove(change.Node.ID)
+			}
+		case <-publish:
+			e.lock.RLock()
+			changed := e.version != e.published
+			version := e.version
+			e.lock.RUnlock()
+			if !changed {
+				continue
+			}
+			msg, err := message.New(message.TypeCharts, e.Charts())
+			if err != nil {
+				e.service.Log().Warningf("Can't create charts message, error: %s", err)
+				continue
+			}
+			e.published = version
+			select {
+			case e.service.Message <- service.Message{Content: msg.Content, Type: msg.Type}:
+			case <-e.quit:
+				return
+			}
+		}
+	}
+}
+
+// heavier return true if the block a has more total difficulty than b. If the
+// total difficulty is the same or unknown, the highest block wins
+func heavier(a, b *Block) bool {
+	tdA, okA := new(big.Int).SetString(a.TotalDifficulty, 10)
+	tdB, okB := new(big.Int).SetString(b.TotalDifficulty, 10)
+	if okA && okB {
+		if cmp := tdA.Cmp(tdB); cmp != 0 {
+			return cmp > 0
+		}
+	}
+	return a.Number > b.Number
+}
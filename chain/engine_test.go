@@ -0,0 +1,50 @@
+package chain
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// closer is a node connection that does nothing when closed
+type closer struct{}
+
+func (closer) Close() error { return nil }
+
+func TestDisconnectedNodeStatsRemoved(t *testing.T) {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	channel := &service.Channel{
+		Message: make(chan service.Message, 16),
+		Nodes:   service.NewRegistry(service.RejectDuplicate),
+		Logger:  logger,
+	}
+	// without interval nor TTL, like the zero value of the server options
+	e := New(Config{Window: 10}, channel)
+	defer e.Close()
+
+	conn := closer{}
+	for _, id := range []string{"node-1", "node-2"} {
+		if _, err := channel.Nodes.Connect(id, conn); err != nil {
+			t.Fatal(err)
+		}
+		e.Consume(id, &message.StatsReport{ID: id, Stats: message.NodeStats{Active: true, Peers: 10}}, time.Now())
+	}
+	if network := e.Network(); network.ActiveNodes != 2 {
+		t.Fatalf("ActiveNodes = %d, want 2", network.ActiveNodes)
+	}
+
+	channel.Nodes.Disconnect("node-1", conn)
+	for start := time.Now(); e.Network().ActiveNodes != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("ActiveNodes = %d after a node disconnected, want 1", e.Network().ActiveNodes)
+		}
+	}
+	if network := e.Network(); network.AvgPeers != 10 {
+		t.Errorf("AvgPeers = %f, want 10", network.AvgPeers)
+	}
+}
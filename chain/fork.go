@@ -0,0 +1,356 @@
+package chain
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+)
+
+// maxEvents is the number of fork and reorg events kept by the detector
+const maxEvents int = 100
+
+// DetectorConfig contains the settings used by the fork detector
+type DetectorConfig struct {
+	// Window is the number of heights, counting back from the head of each
+	// node, whose hashes are kept to compare chains
+	Window int
+
+	// Threshold is the time nodes must follow different chains before a
+	// chain split is reported
+	Threshold time.Duration
+}
+
+// Branch is one of the chains followed by the nodes during a fork
+type Branch struct {
+	Hash   string   `json:"hash"`
+	Number uint64   `json:"number"`
+	Nodes  []string `json:"nodes"`
+}
+
+// Fork is reported when nodes disagree on the block hash at a given height, or
+// follow different chains for longer than the threshold
+type Fork struct {
+	// From and To are the block range affected by the fork
+	From     uint64   `json:"from"`
+	To       uint64   `json:"to"`
+	Branches []Branch `json:"branches"`
+
+	// Split is true if the fork was detected because the nodes followed
+	// different chains for longer than the threshold
+	Split bool `json:"split"`
+
+	// Detected is the time of detection in milliseconds since epoch
+	Detected int64 `json:"detected"`
+}
+
+// Reorg is reported when the head of a node is replaced by a block at the same
+// or lower height
+type Reorg struct {
+	ID      string `json:"id"`
+	From    uint64 `json:"from"`
+	To      uint64 `json:"to"`
+	OldHash string `json:"oldHash"`
+	NewHash string `json:"newHash"`
+	Depth   uint64 `json:"depth"`
+
+	// Detected is the time of detection in milliseconds since epoch
+	Detected int64 `json:"detected"`
+}
+
+// head is the last block reported by a node
+type head struct {
+	number uint64
+	hash   string
+}
+
+// Detector groups the nodes by the chain they follow to detect forks and
+// reorgs. It's safe for concurrent use
+type Detector struct {
+	lock    sync.Mutex
+	config  DetectorConfig
+	heads   map[string]head
+	chains  map[string]map[uint64]string
+	heights map[uint64]map[string][]string
+
+	// splitSince is the time the nodes started to follow different chains,
+	// zero if all nodes follow the same chain
+	splitSince time.Time
+	reported   bool
+
+	forks   []Fork
+	reorgs  []Reorg
+	service *service.Channel
+	changes <-chan service.Change
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// NewDetector creates a new Detector that reports forks and reorgs to the service clients
+func NewDetector(config DetectorConfig, service *service.Channel) *Detector {
+	defer func() { service.Log().Info("Fork detector started successfully") }()
+	if config.Window <= 0 {
+		config.Window = 1
+	}
+	d := &Detector{
+		config:  config,
+		heads:   make(map[string]head),
+		chains:  make(map[string]map[uint64]string),
+		heights: make(map[uint64]map[string][]string),
+		service: service,
+		changes: service.Nodes.Watch(64),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go d.loop()
+	return d
+}
+
+// Close stops checking for chain splits
+func (d *Detector) Close() {
+	close(d.quit)
+	<-d.done
+}
+
+// Consume processes the blocks reported by the nodes
+func (d *Detector) Consume(id string, value interface{}, received time.Time) {
+	report, ok := value.(*message.BlockReport)
+	if !ok {
+		return
+	}
+	var events []interface{}
+	d.lock.Lock()
+	block := report.Block
+	if prev, ok := d.heads[id]; ok && block.Number <= prev.number && block.Hash != prev.hash {
+		reorg := Reorg{
+			ID:       id,
+			From:     block.Number,
+			To:       prev.number,
+			OldHash:  prev.hash,
+			NewHash:  block.Hash,
+			Depth:    prev.number - block.Number + 1,
+			Detected: millis(received),
+		}
+		d.reorgs = appendReorg(d.reorgs, reorg)
+		events = append(events, reorg)
+	}
+	d.heads[id] = head{number: block.Number, hash: block.Hash}
+	d.record(id, block.Number, block.Hash)
+	if fork, ok := d.disagreement(block.Number, block.Hash, received); ok {
+		d.forks = appendFork(d.forks, fork)
+		events = append(events, fork)
+	}
+	d.lock.Unlock()
+
+	for _, event := range events {
+		d.emit(event)
+	}
+}
+
+// Remove forgets the head of a node, i.e. when it disconnects
+func (d *Detector) Remove(id string) {
+	d.lock.Lock()
+	delete(d.heads, id)
+	delete(d.chains, id)
+	d.lock.Unlock()
+}
+
+// Forks return the latest forks detected
+func (d *Detector) Forks() []Fork {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]Fork(nil), d.forks...)
+}
+
+// Reorgs return the latest reorgs detected
+func (d *Detector) Reorgs() []Reorg {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]Reorg(nil), d.reorgs...)
+}
+
+// record stores the hash reported by the node at the given height, and prunes
+// the heights out of the window. Must be called holding the lock
+func (d *Detector) record(id string, number uint64, hash string) {
+	chain, ok := d.chains[id]
+	if !ok {
+		chain = make(map[uint64]string)
+		d.chains[id] = chain
+	}
+	chain[number] = hash
+	if d.heights[number] == nil {
+		d.heights[number] = make(map[string][]string)
+	}
+	d.heights[number][hash] = appendUnique(d.heights[number][hash], id)
+
+	window := uint64(d.config.Window)
+	for n := range chain {
+		if n+window <= number {
+			delete(chain, n)
+		}
+	}
+	var highest uint64
+	for _, h := range d.heads {
+		if h.number > highest {
+			highest = h.number
+		}
+	}
+	for n := range d.heights {
+		if n+window <= highest {
+			delete(d.heights, n)
+		}
+	}
+}
+
+// disagreement return a fork if the given hash is the first competing hash
+// reported at that height. Must be called holding the lock
+func (d *Detector) disagreement(number uint64, hash string, detected time.Time) (Fork, bool) {
+	hashes := d.heights[number]
+	if len(hashes) < 2 || len(hashes[hash]) != 1 {
+		return Fork{}, false
+	}
+	fork := Fork{From: number, To: number, Detected: millis(detected)}
+	for h, nodes := range hashes {
+		fork.Branches = append(fork.Branches, Branch{Hash: h, Number: number, Nodes: append([]string(nil), nodes...)})
+	}
+	sort.Slice(fork.Branches, func(i, j int) bool { return fork.Branches[i].Hash < fork.Branches[j].Hash })
+	return fork, true
+}
+
+// groups return the branches followed by the nodes. Nodes are in the same
+// branch if the highest node of the branch has the same hash at the height of
+// the node head, or if that height is unknown. Must be called holding the lock
+func (d *Detector) groups() []Branch {
+	ids := make([]string, 0, len(d.heads))
+	for id := range d.heads {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := d.heads[ids[i]], d.heads[ids[j]]
+		if a.number != b.number {
+			return a.number > b.number
+		}
+		return ids[i] < ids[j]
+	})
+	var branches []Branch
+	for _, id := range ids {
+		h := d.heads[id]
+		joined := false
+		for n := range branches {
+			leader := branches[n].Nodes[0]
+			hash, known := d.chains[leader][h.number]
+			if !known || hash == h.hash {
+				branches[n].Nodes = append(branches[n].Nodes, id)
+				joined = true
+				break
+			}
+		}
+		if !joined {
+			branches = append(branches, Branch{Hash: h.hash, Number: h.number, Nodes: []string{id}})
+		}
+	}
+	return branches
+}
+
+// loop forgets the nodes that disconnect and checks periodically if the nodes
+// follow different chains for longer than the threshold
+func (d *Detector) loop() {
+	defer close(d.done)
+	var check <-chan time.Time
+	if d.config.Threshold > 0 {
+		ticker := time.NewTicker(d.config.Threshold / 2)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	for {
+		select {
+		case <-d.quit:
+			return
+		case change := <-d.changes:
+			if change.Type != service.NodeConnected {
+				d.Remove(change.Node.ID)
+			}
+		case now := <-check:
+			if fork, ok := d.checkSplit(now); ok {
+				d.emit(fork)
+			}
+		}
+	}
+}
+
+// checkSplit return a fork the first time the nodes follow different chains
+// for longer than the threshold
+func (d *Detector) checkSplit(now time.Time) (Fork, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	branches := d.groups()
+	if len(branches) < 2 {
+		d.splitSince, d.reported = time.Time{}, false
+		return Fork{}, false
+	}
+	if d.splitSince.IsZero() {
+		d.splitSince = now
+	}
+	if d.reported || now.Sub(d.splitSince) < d.config.Threshold {
+		return Fork{}, false
+	}
+	d.reported = true
+	fork := Fork{From: branches[0].Number, To: branches[0].Number, Branches: branches, Split: true, Detected: millis(now)}
+	for _, branch := range branches {
+		if branch.Number < fork.From {
+			fork.From = branch.Number
+		}
+	}
+	d.forks = appendFork(d.forks, fork)
+	return fork, true
+}
+
+// emit sends a fork or reorg event to the clients
+func (d *Detector) emit(event interface{}) {
+	msgType, node := message.TypeFork, ""
+	if reorg, ok := event.(Reorg); ok {
+		msgType, node = message.TypeReorg, reorg.ID
+	}
+	msg, err := message.New(msgType, event)
+	if err != nil {
+		d.service.Log().Warningf("Can't create %s message, error: %s", msgType, err)
+		return
+	}
+	d.service.Log().Warningf("Detected %s: %s", msgType, msg.Value)
+	d.service.Message <- service.Message{Content: msg.Content, Type: msgType, Node: node}
+}
+
+// appendFork appends the fork, keeping only the latest events
+func appendFork(forks []Fork, fork Fork) []Fork {
+	forks = append(forks, fork)
+	if len(forks) > maxEvents {
+		forks = forks[len(forks)-maxEvents:]
+	}
+	return forks
+}
+
+// appendReorg appends the reorg, keeping only the latest events
+func appendReorg(reorgs []Reorg, reorg Reorg) []Reorg {
+	reorgs = append(reorgs, reorg)
+	if len(reorgs) > maxEvents {
+		reorgs = reorgs[len(reorgs)-maxEvents:]
+	}
+	return reorgs
+}
+
+// appendUnique appends the id if it isn't in the list
+func appendUnique(ids []string, id string) []string {
+	for _, i := range ids {
+		if i == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+// millis return the time in milliseconds since epoch
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
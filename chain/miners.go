@@ -0,0 +1,139 @@
+package chain
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+)
+
+// Miners is the endpoint where the leaderboard of block producers is served
+const Miners string = "/miners"
+
+// Miner is an entry of the leaderboard of block producers
+type Miner struct {
+	Miner  string  `json:"miner"`
+	Blocks int     `json:"blocks"`
+	Share  float64 `json:"share"`
+}
+
+// Leaderboard counts the blocks produced by each miner in the last blocks. On
+// clique networks the miner reported by geth is the signer of the block, so
+// the leaderboard shows the signer rotation. It's safe for concurrent use
+type Leaderboard struct {
+	lock    sync.RWMutex
+	blocks  int
+	miners  map[uint64]string
+	hashes  map[uint64]string
+	highest uint64
+	service *service.Channel
+}
+
+// NewLeaderboard creates a new Leaderboard of the given number of blocks, that
+// sends the changes to the service clients
+func NewLeaderboard(blocks int, service *service.Channel) *Leaderboard {
+	if blocks <= 0 {
+		blocks = 1
+	}
+	return &Leaderboard{
+		blocks:  blocks,
+		miners:  make(map[uint64]string),
+		hashes:  make(map[uint64]string),
+		service: service,
+	}
+}
+
+// Consume counts the blocks reported by the nodes. Blocks reported by more
+// than one node are counted once
+func (l *Leaderboard) Consume(id string, value interface{}, received time.Time) {
+	var blocks []message.BlockStats
+	switch v := value.(type) {
+	case *message.BlockReport:
+		blocks = []message.BlockStats{v.Block}
+	case *message.HistoryReport:
+		blocks = v.History
+	default:
+		return
+	}
+	changed := false
+	l.lock.Lock()
+	for _, block := range blocks {
+		changed = l.add(block) || changed
+	}
+	l.lock.Unlock()
+	if changed {
+		l.emit()
+	}
+}
+
+// add counts the block, replacing the block previously known at the same
+// height. Must be called holding the lock
+func (l *Leaderboard) add(block message.BlockStats) bool {
+	if block.Miner == "" || l.hashes[block.Number] == block.Hash {
+		return false
+	}
+	if block.Number+uint64(l.blocks) <= l.highest {
+		return false
+	}
+	l.hashes[block.Number] = block.Hash
+	l.miners[block.Number] = block.Miner
+	if block.Number > l.highest {
+		l.highest = block.Number
+		for number := range l.hashes {
+			if number+uint64(l.blocks) <= l.highest {
+				delete(l.hashes, number)
+				delete(l.miners, number)
+			}
+		}
+	}
+	return true
+}
+
+// Miners return the block producers sorted by the number of blocks
+func (l *Leaderboard) Miners() []Miner {
+	l.lock.RLock()
+	counts := make(map[string]int)
+	for _, miner := range l.miners {
+		counts[miner]++
+	}
+	total := len(l.miners)
+	l.lock.RUnlock()
+
+	miners := make([]Miner, 0, len(counts))
+	for miner, blocks := range counts {
+		miners = append(miners, Miner{Miner: miner, Blocks: blocks, Share: float64(blocks) / float64(total)})
+	}
+	sort.Slice(miners, func(i, j int) bool {
+		if miners[i].Blocks != miners[j].Blocks {
+			return miners[i].Blocks > miners[j].Blocks
+		}
+		return miners[i].Miner < miners[j].Miner
+	})
+	return miners
+}
+
+// ServeHTTP writes the leaderboard as JSON
+func (l *Leaderboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l.Miners()); err != nil {
+		l.service.Log().Warningf("Error writing miners leaderboard, %s", err)
+	}
+}
+
+// emit sends the leaderboard to the clients
+func (l *Leaderboard) emit() {
+	msg, err := message.New(message.TypeMiners, l.Miners())
+	if err != nil {
+		l.service.Log().Warningf("Can't create miners message, error: %s", err)
+		return
+	}
+	l.service.Message <- service.Message{Content: msg.Content, Type: msg.Type}
+}
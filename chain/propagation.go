@@ -0,0 +1,133 @@
+package chain
+
+import (
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+)
+
+const (
+	// propagationHistory is the number of delays kept for each node
+	propagationHistory int = 40
+
+	// histogramBins is the number of bins of the propagation histogram
+	histogramBins int = 40
+
+	// histogramMax is the maximum delay, in milliseconds, of the histogram.
+	// Longer delays are counted in the last bin
+	histogramMax int64 = 10000
+)
+
+// Bin is a bin of the propagation histogram
+type Bin struct {
+	// X is the lower bound of the bin and Dx its width, in milliseconds
+	X  int64 `json:"x"`
+	Dx int64 `json:"dx"`
+
+	// Y is the fraction of delays in the bin
+	Y          float64 `json:"y"`
+	Frequency  int     `json:"frequency"`
+	Cumulative int     `json:"cumulative"`
+	CumPercent float64 `json:"cumpercent"`
+}
+
+// PropagationChart is the histogram of the delays of the blocks in the window
+type PropagationChart struct {
+	Histogram []Bin   `json:"histogram"`
+	Avg       float64 `json:"avg"`
+}
+
+// propagate records the time the node reported the block, relative to the
+// first time any node reported it, and publishes it
+func (e *Engine) propagate(id string, stats message.BlockStats, received time.Time) {
+	e.lock.Lock()
+	block, ok := e.blocks[stats.Hash]
+	if !ok {
+		e.lock.Unlock()
+		return
+	}
+	delay := int64(received.Sub(block.Arrived) / time.Millisecond)
+	if delay < 0 {
+		delay = 0
+	}
+	e.delays[stats.Hash] = append(e.delays[stats.Hash], delay)
+	history := append(e.nodeDelays[id], delay)
+	if len(history) > propagationHistory {
+		history = history[len(history)-propagationHistory:]
+	}
+	e.nodeDelays[id] = history
+	report := &message.PropagationReport{
+		ID:             id,
+		Number:         stats.Number,
+		Hash:           stats.Hash,
+		Propagation:    delay,
+		PropagationAvg: average(history),
+		History:        append([]int64(nil), history...),
+	}
+	e.lock.Unlock()
+
+	msg, err := message.New(message.TypePropagation, report)
+	if err != nil {
+		e.service.Log().Warningf("Can't create propagation message for node[%s], error: %s", id, err)
+		return
+	}
+	e.service.Nodes.SetLatest(id, message.TypePropagation, msg.Content)
+	e.service.Message <- service.Message{Content: msg.Content, Type: msg.Type, Node: id}
+}
+
+// Propagation return the propagation history of the node, and its average
+func (e *Engine) Propagation(id string) ([]int64, int64) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	history := e.nodeDelays[id]
+	return append([]int64(nil), history...), average(history)
+}
+
+// propagationChart builds the histogram of the delays of the blocks in the
+// window. Must be called holding the lock
+func (e *Engine) propagationChart() PropagationChart {
+	dx := histogramMax / int64(histogramBins)
+	chart := PropagationChart{Histogram: make([]Bin, histogramBins)}
+	for n := range chart.Histogram {
+		chart.Histogram[n].X = int64(n) * dx
+		chart.Histogram[n].Dx = dx
+	}
+	total, sum := 0, int64(0)
+	for _, delays := range e.delays {
+		for _, delay := range delays {
+			bin := int(delay / dx)
+			if bin >= histogramBins {
+				bin = histogramBins - 1
+			}
+			chart.Histogram[bin].Frequency++
+			total++
+			sum += delay
+		}
+	}
+	if total == 0 {
+		return chart
+	}
+	cumulative := 0
+	for n := range chart.Histogram {
+		bin := &chart.Histogram[n]
+		cumulative += bin.Frequency
+		bin.Y = float64(bin.Frequency) / float64(total)
+		bin.Cumulative = cumulative
+		bin.CumPercent = float64(cumulative) / float64(total)
+	}
+	chart.Avg = float64(sum) / float64(total)
+	return chart
+}
+
+// average return the average of the values, zero if there are no values
+func average(values []int64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum int64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / int64(len(values))
+}
@@ -0,0 +1,249 @@
+package journal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// filePrefix and fileSuffix surround the creation time in the journal file names
+	filePrefix = "relay-"
+	fileSuffix = ".jsonl.gz"
+
+	// fileTime is the format of the creation time in the journal file names
+	fileTime = "20060102T150405.000"
+
+	// flushInterval is the time between flushes of the compressor buffer
+	flushInterval = time.Second
+)
+
+// Entry is a frame received from a node, or the end of a node connection
+type Entry struct {
+	// Time is when the frame was received
+	Time time.Time `json:"time"`
+
+	// Conn identifies the connection that received the frame
+	Conn uint64 `json:"conn"`
+
+	// Node is the id of the node, empty until the node authenticates
+	Node string `json:"node,omitempty"`
+
+	// Frame is the content received, untouched except for the node secret
+	Frame string `json:"frame,omitempty"`
+
+	// Closed is true if the entry marks the end of the connection
+	Closed bool `json:"closed,omitempty"`
+}
+
+// Config contains the settings used by the journal writer
+type Config struct {
+	// Dir is the directory where the journal files are written
+	Dir string
+
+	// MaxSize is the size, before compression, of a journal file after which
+	// a new file is started
+	MaxSize int64
+
+	// MaxFiles is the number of journal files kept. If zero, all files are kept
+	MaxFiles int
+}
+
+// Writer writes the entries to rotating gzip compressed files, one JSON
+// document per line. It's safe for concurrent use
+type Writer struct {
+	lock    sync.Mutex
+	config  Config
+	file    *os.File
+	gz      *gzip.Writer
+	written int64
+	dirty   bool
+	quit    chan struct{}
+}
+
+// NewWriter creates a new Writer that writes the journal files in the
+// directory of the configuration, creating it if it doesn't exist
+func NewWriter(config Config) (*Writer, error) {
+	defer func() { log.Infof("Recording node traffic in %s", config.Dir) }()
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &Writer{config: config, quit: make(chan struct{})}
+	go w.loop()
+	return w, nil
+}
+
+// loop flushes the written entries every flush interval, so they reach the
+// file even if the server doesn't stop cleanly
+func (w *Writer) loop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.lock.Lock()
+			if w.dirty && w.gz != nil {
+				if err := w.gz.Flush(); err != nil {
+					log.Warningf("Can't flush recorded traffic, error: %s", err)
+				}
+				w.dirty = false
+			}
+			w.lock.Unlock()
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// Write appends the entry to the current journal file, starting a new file
+// if the current one is full. The secret of hello messages is removed
+func (w *Writer) Write(entry Entry) error {
+	entry.Frame = stripSecret(entry.Frame)
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.gz == nil || (w.config.MaxSize > 0 && w.written >= w.config.MaxSize) {
+		if err := w.rotate(entry.Time); err != nil {
+			return err
+		}
+	}
+	n, err := w.gz.Write(content)
+	w.written += int64(n)
+	w.dirty = true
+	return err
+}
+
+// Close closes the current journal file
+func (w *Writer) Close() error {
+	close(w.quit)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.closeFile()
+}
+
+// rotate closes the current file, starts a new one and removes the oldest
+// files. Must be called holding the lock
+func (w *Writer) rotate(now time.Time) error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	name := filePrefix + now.UTC().Format(fileTime) + fileSuffix
+	file, err := os.OpenFile(filepath.Join(w.config.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.gz = gzip.NewWriter(file)
+	w.written = 0
+	if w.config.MaxFiles <= 0 {
+		return nil
+	}
+	files, err := Files(w.config.Dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > w.config.MaxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// closeFile flushes and closes the current file. Must be called holding the lock
+func (w *Writer) closeFile() error {
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.gz, w.file = nil, nil
+	return err
+}
+
+// stripSecret return the frame without the secret, if it's a hello message.
+// Other frames, even if they can't be parsed, are returned untouched
+func stripSecret(frame string) string {
+	msg, err := message.Parse([]byte(frame))
+	if err != nil || msg.Type != message.TypeHello {
+		return frame
+	}
+	var hello map[string]json.RawMessage
+	if err := json.Unmarshal(msg.Value, &hello); err != nil {
+		return frame
+	}
+	delete(hello, "secret")
+	stripped, err := message.New(message.TypeHello, hello)
+	if err != nil {
+		return frame
+	}
+	return string(stripped.Content)
+}
+
+// Files return the journal files of the directory, from the oldest to the newest
+func Files(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"+fileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Read reads the entries of the given journal files, in order, calling
+// handle with each one. Reading stops at the first error returned by handle.
+// A truncated file, like the last one written by a server that didn't stop
+// cleanly, ends the reading of that file
+func Read(files []string, handle func(entry Entry) error) error {
+	for _, path := range files {
+		if err := readFile(path, handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFile reads the entries of a journal file
+func readFile(path string, handle func(entry Entry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	decoder := json.NewDecoder(gz)
+	for {
+		var entry Entry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Warningf("Ignoring the rest of %s, %s", path, err)
+			return nil
+		}
+		if err := handle(entry); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package journal
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplayConfig contains the settings used to replay a journal
+type ReplayConfig struct {
+	// URL is the websocket endpoint of the relay, like ws://localhost:3000/api
+	URL string
+
+	// Secret replaces the secret of the hello messages, which is never recorded
+	Secret string
+
+	// Speed multiplies the pace of the recorded traffic. If zero, entries are
+	// sent as fast as possible
+	Speed float64
+}
+
+// replayer sends the entries of a journal to the relay, opening a connection
+// for each recorded connection
+type replayer struct {
+	config ReplayConfig
+	conns  map[uint64]*websocket.Conn
+	first  time.Time
+	start  time.Time
+	sent   int
+}
+
+// Replay sends the frames of the journal files to the relay, keeping the time
+// between them, and return when all of them are sent
+func Replay(files []string, config ReplayConfig) error {
+	r := &replayer{config: config, conns: make(map[uint64]*websocket.Conn)}
+	defer r.closeAll()
+	if err := Read(files, r.replay); err != nil {
+		return err
+	}
+	log.Infof("Replayed %d frames from %d files", r.sent, len(files))
+	return nil
+}
+
+// replay waits until the time of the entry and sends it
+func (r *replayer) replay(entry Entry) error {
+	if r.first.IsZero() {
+		r.first, r.start = entry.Time, time.Now()
+	}
+	if r.config.Speed > 0 {
+		offset := time.Duration(float64(entry.Time.Sub(r.first)) / r.config.Speed)
+		time.Sleep(time.Until(r.start.Add(offset)))
+	}
+	if entry.Closed {
+		if conn, ok := r.conns[entry.Conn]; ok {
+			conn.Close()
+			delete(r.conns, entry.Conn)
+		}
+		return nil
+	}
+	conn, ok := r.conns[entry.Conn]
+	if !ok {
+		var err error
+		if conn, _, err = websocket.DefaultDialer.Dial(r.config.URL, nil); err != nil {
+			return err
+		}
+		r.conns[entry.Conn] = conn
+		go discard(conn)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, r.frame(entry.Frame)); err != nil {
+		log.Warningf("Can't replay frame of node[%s], %s", entry.Node, err)
+		conn.Close()
+		delete(r.conns, entry.Conn)
+		return nil
+	}
+	r.sent++
+	return nil
+}
+
+// frame return the recorded frame, with the configured secret if it's a
+// hello message. Frames that can't be parsed are sent untouched
+func (r *replayer) frame(frame string) []byte {
+	msg, err := message.Parse([]byte(frame))
+	if err != nil || msg.Type != message.TypeHello {
+		return []byte(frame)
+	}
+	var hello map[string]json.RawMessage
+	if err := json.Unmarshal(msg.Value, &hello); err != nil {
+		return []byte(frame)
+	}
+	secret, _ := json.Marshal(r.config.Secret)
+	hello["secret"] = secret
+	rewritten, err := message.New(message.TypeHello, hello)
+	if err != nil {
+		return []byte(frame)
+	}
+	return rewritten.Content
+}
+
+// closeAll closes the connections still open
+func (r *replayer) closeAll() {
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+}
+
+// discard reads the messages sent by the relay until the connection is closed
+func discard(conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
@@ -1,20 +1,32 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/eskoltech/ethstats-server/broadcast"
+	"github.com/eskoltech/ethstats-server/journal"
 	"github.com/eskoltech/ethstats-server/relay"
+	"github.com/eskoltech/ethstats-server/sanitize"
+	"github.com/eskoltech/ethstats-server/server"
 	"github.com/eskoltech/ethstats-server/service"
+	"github.com/eskoltech/ethstats-server/storage"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	version string = "v0.1.0\n"
-	banner  string = `
+
+	// shutdownTimeout is the time pending requests have to finish when the
+	// server is stopped
+	shutdownTimeout = 10 * time.Second
+
+	banner string = `
         __  .__              __          __          
   _____/  |_|  |__   _______/  |______ _/  |_  ______
 _/ __ \   __\  |  \ /  ___/\   __\__  \\   __\/  ___/
@@ -26,6 +38,24 @@ _/ __ \   __\  |  \ /  ___/\   __\__  \\   __\/  ___/
 
 var addr = flag.String("addr", "localhost:3000", "Server address")
 var secret = flag.String("secret", "", "Server secret")
+var authTimeout = flag.Duration("auth-timeout", 10*time.Second, "Time a node has to authenticate after connecting")
+var inactiveTimeout = flag.Duration("inactive-timeout", time.Minute, "Time a node can stay without reporting before it's disconnected")
+var duplicates = flag.String("duplicates", "reject", "Policy for nodes connecting with the id of a connected node: reject, replace or suffix")
+var queueSize = flag.Int("queue-size", 256, "Maximum number of messages waiting to be sent to a dashboard client")
+var overflow = flag.String("overflow", "drop-oldest", "Policy when the queue of a client is full: drop-oldest, coalesce or disconnect")
+var protocol = flag.String("protocol", "raw", "Protocol used to talk to dashboard clients: raw or netstats")
+var backlog = flag.Int("backlog", 1024, "Number of messages kept so event stream clients can resume after reconnecting")
+var window = flag.Int("window", 100, "Number of blocks used to compute the network stats")
+var forkThreshold = flag.Duration("fork-threshold", 30*time.Second, "Time nodes can follow different chains before a chain split is reported")
+var historyLimit = flag.Int("history-limit", 50, "Maximum number of blocks requested to a node to fill the history, zero to disable it")
+var historyInterval = flag.Duration("history-interval", 30*time.Second, "Minimum time between history requests sent to the same node")
+var labels = flag.String("labels", "", "Comma separated labels of the nodes, as id=label")
+var dataDir = flag.String("data-dir", "", "Directory where the history of nodes and blocks is stored, kept in memory if empty")
+var retention = flag.String("retention", "", "Comma separated retention of the stored stats, as tier=duration with tiers raw, 1m, 1h and 1d")
+var record = flag.String("record", "", "Directory where the traffic received from the nodes is recorded, disabled if empty")
+var recordSize = flag.Int64("record-size", 64, "Size in MB of the recorded traffic after which a new journal file is started")
+var recordFiles = flag.Int("record-files", 10, "Number of journal files with recorded traffic kept, zero to keep all")
+var redact = flag.String("redact", "", "Comma separated fields removed from node messages, as [type:]field[.field...]")
 
 // main is the program entry point. If the server secret is not set when
 // init, the server can't start
@@ -34,27 +64,128 @@ func main() {
 		FullTimestamp:   true,
 		TimestampFormat: time.RFC3339,
 	})
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		simulate(os.Args[2:])
+		return
+	}
 	flag.Parse()
 	fmt.Printf(banner, version)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	serve(interrupt)
+}
+
+// serve starts the server using the settings given in the flags, and shuts it
+// down gracefully when a signal is received
+func serve(interrupt <-chan os.Signal) {
+	srv, release := newServer()
+	defer release()
+	if err := srv.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	<-interrupt
+	shutdown(srv)
+}
 
+// newServer creates the server using the settings given in the flags. The
+// returned function releases the store and the traffic journal once the
+// server is shut down
+func newServer() (*server.Server, func()) {
 	// check if server secret is valid
 	if *secret == "" {
 		log.Fatal("Server secret can't be empty")
 	}
-	log.Infof("Starting websocket server in %s", *addr)
+	rules, err := sanitize.ParseRules(*redact)
+	if err != nil {
+		log.Fatalf("Invalid redaction rules %q: %s", *redact, err)
+	}
+	policy, err := service.ParseDuplicatePolicy(*duplicates)
+	if err != nil {
+		log.Fatal(err)
+	}
+	overflowPolicy, err := broadcast.ParseOverflowPolicy(*overflow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientProtocol, err := broadcast.ParseProtocol(*protocol)
+	if err != nil {
+		log.Fatal(err)
+	}
+	nodeLabels, err := service.ParseLabels(*labels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	retentions, err := storage.ParseRetention(*retention)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Service channel to exchange info
-	channel := &service.Channel{
-		Message: make(chan []byte),
-		Nodes:   make(map[string][]byte),
+	var traffic *journal.Writer
+	if *record != "" {
+		traffic, err = journal.NewWriter(journal.Config{
+			Dir:      *record,
+			MaxSize:  *recordSize << 20,
+			MaxFiles: *recordFiles,
+		})
+		if err != nil {
+			log.Fatalf("Can't record traffic in %q: %s", *record, err)
+		}
+	}
+	store, err := openStore(*dataDir)
+	if err != nil {
+		log.Fatalf("Can't open storage in %q: %s", *dataDir, err)
+	}
+	release := func() {
+		store.Close()
+		if traffic != nil {
+			traffic.Close()
+		}
 	}
-	nodeRelay := relay.New(channel, *secret)
-	defer nodeRelay.Close()
 
-	server := broadcast.New(channel)
-	defer server.Close()
+	srv, err := server.New(server.Options{
+		Addr:            *addr,
+		Auth:            relay.SecretAuthenticator(*secret),
+		Store:           store,
+		Duplicates:      policy,
+		Labels:          nodeLabels,
+		AuthTimeout:     *authTimeout,
+		InactiveTimeout: *inactiveTimeout,
+		Sanitizer:       sanitize.New(rules...),
+		HistoryLimit:    *historyLimit,
+		HistoryInterval: *historyInterval,
+		Journal:         traffic,
+		QueueSize:       *queueSize,
+		Overflow:        overflowPolicy,
+		Protocol:        clientProtocol,
+		Backlog:         *backlog,
+		Window:          *window,
+		ForkThreshold:   *forkThreshold,
+		Retention:       retentions,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return srv, release
+}
 
-	http.HandleFunc(relay.Api, nodeRelay.HandleRequest)
-	http.HandleFunc(broadcast.Root, server.HandleRequest)
-	log.Fatal(http.ListenAndServe(*addr, nil))
+// shutdown stops the server, giving the pending requests some time to finish
+func shutdown(srv *server.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("Can't shut down the server gracefully, error: %s", err)
+	}
+}
+
+// openStore opens the store in the given directory, or an in-memory store if
+// the directory is empty
+func openStore(dir string) (storage.Store, error) {
+	if dir == "" {
+		return storage.NewMemory(), nil
+	}
+	return storage.Open(dir)
 }
@@ -0,0 +1,17 @@
+package message
+
+const (
+	// TypeSubscribe is sent by the clients to receive only some messages
+	TypeSubscribe string = "subscribe"
+
+	// TypeUnsubscribe is sent by the clients to stop receiving some messages
+	TypeUnsubscribe string = "unsubscribe"
+)
+
+// Subscription contains the message types, node ids and node labels of a
+// subscribe or unsubscribe command sent by a client
+type Subscription struct {
+	Types  []string `json:"types"`
+	Nodes  []string `json:"nodes"`
+	Labels []string `json:"labels"`
+}
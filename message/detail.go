@@ -8,8 +8,9 @@ import (
 
 // AuthMessage is the struct sent by the server on the first connection
 type AuthMessage struct {
-	ID     string `json:"id"`
-	Secret string `json:"secret"`
+	ID     string   `json:"id"`
+	Info   NodeInfo `json:"info"`
+	Secret string   `json:"secret"`
 }
 
 // SendResponse send the ready response to the node to initiate the communication
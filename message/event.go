@@ -0,0 +1,68 @@
+package message
+
+import "time"
+
+// Message types emitted by this server
+const (
+	// TypeNodeEvent is emitted when the state of a node connection changes
+	TypeNodeEvent string = "node-event"
+
+	// TypeCharts is emitted with the network stats of the latest blocks
+	TypeCharts string = "charts"
+
+	// TypePropagation is emitted after a node reports a block, with the time
+	// the block took to reach the node
+	TypePropagation string = "propagation"
+
+	// TypeFork and TypeReorg are emitted when nodes follow different chains
+	// or replace their head
+	TypeFork  string = "fork"
+	TypeReorg string = "reorg"
+
+	// TypeMiners is emitted with the leaderboard of block producers
+	TypeMiners string = "miners"
+)
+
+// Node lifecycle events
+const (
+	EventConnected     string = "connected"
+	EventAuthenticated string = "authenticated"
+	EventAuthFailed    string = "auth-failed"
+	EventInactive      string = "inactive"
+	EventDisconnected  string = "disconnected"
+)
+
+// NodeEvent is sent to the clients when a node connects, authenticates, stops
+// reporting or disconnects
+type NodeEvent struct {
+	// ID of the node, empty if the node isn't authenticated yet
+	ID     string `json:"id,omitempty"`
+	Event  string `json:"event"`
+	Addr   string `json:"addr,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// Time of the event in milliseconds since epoch
+	Time int64 `json:"time"`
+}
+
+// NewNodeEvent creates a new node event happened now
+func NewNodeEvent(event, id, addr, reason string) *NodeEvent {
+	return &NodeEvent{
+		ID:     id,
+		Event:  event,
+		Addr:   addr,
+		Reason: reason,
+		Time:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// PropagationReport contains the delay, in milliseconds, between the first
+// time a block was reported by any node and the time it was reported by a node
+type PropagationReport struct {
+	ID             string  `json:"id"`
+	Number         uint64  `json:"number"`
+	Hash           string  `json:"hash"`
+	Propagation    int64   `json:"propagation"`
+	PropagationAvg int64   `json:"propagationAvg"`
+	History        []int64 `json:"history"`
+}
@@ -0,0 +1,27 @@
+package message
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// HistoryRequest is the message sent by the server to ask a node for a list
+// of past blocks. The node replies with a history message
+type HistoryRequest struct {
+	List []uint64 `json:"list"`
+}
+
+// SendRequest send the history request to the node
+func (h *HistoryRequest) SendRequest(c *websocket.Conn) error {
+	request := map[string][]interface{}{"emit": {TypeHistory, h}}
+	content, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	err = c.WriteMessage(1, content)
+	if err != nil {
+		return err
+	}
+	return nil
+}
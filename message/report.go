@@ -0,0 +1,115 @@
+package message
+
+// Message types emitted by the Ethereum nodes
+const (
+	TypeHello   string = "hello"
+	TypePing    string = "node-ping"
+	TypeLatency string = "latency"
+	TypeBlock   string = "block"
+	TypeHistory string = "history"
+	TypePending string = "pending"
+	TypeStats   string = "stats"
+)
+
+// NodeInfo is the information about the node sent in the hello message
+type NodeInfo struct {
+	Name     string `json:"name"`
+	Node     string `json:"node"`
+	Port     int    `json:"port"`
+	Network  string `json:"net"`
+	Protocol string `json:"protocol"`
+	API      string `json:"api"`
+	Os       string `json:"os"`
+	OsVer    string `json:"os_v"`
+	Client   string `json:"client"`
+	History  bool   `json:"canUpdateHistory"`
+}
+
+// BlockStats is the information reported about a block
+type BlockStats struct {
+	Number          uint64    `json:"number"`
+	Hash            string    `json:"hash"`
+	ParentHash      string    `json:"parentHash"`
+	Timestamp       uint64    `json:"timestamp"`
+	Miner           string    `json:"miner"`
+	GasUsed         uint64    `json:"gasUsed"`
+	GasLimit        uint64    `json:"gasLimit"`
+	Difficulty      string    `json:"difficulty"`
+	TotalDifficulty string    `json:"totalDifficulty"`
+	Transactions    []TxStats `json:"transactions"`
+	TxHash          string    `json:"transactionsRoot"`
+	Root            string    `json:"stateRoot"`
+	Uncles          []Uncle   `json:"uncles"`
+}
+
+// TxStats is the information reported about a transaction in a block
+type TxStats struct {
+	Hash string `json:"hash"`
+}
+
+// Uncle is the header of an uncle block. Numeric values are hex encoded
+type Uncle struct {
+	ParentHash  string `json:"parentHash"`
+	UncleHash   string `json:"sha3Uncles"`
+	Miner       string `json:"miner"`
+	Root        string `json:"stateRoot"`
+	TxHash      string `json:"transactionsRoot"`
+	ReceiptHash string `json:"receiptsRoot"`
+	Bloom       string `json:"logsBloom"`
+	Difficulty  string `json:"difficulty"`
+	Number      string `json:"number"`
+	GasLimit    string `json:"gasLimit"`
+	GasUsed     string `json:"gasUsed"`
+	Timestamp   string `json:"timestamp"`
+	Extra       string `json:"extraData"`
+	MixDigest   string `json:"mixHash"`
+	Nonce       string `json:"nonce"`
+	Hash        string `json:"hash"`
+}
+
+// PendingStats is the number of pending transactions of the node
+type PendingStats struct {
+	Pending int `json:"pending"`
+}
+
+// NodeStats is the information reported about the node status
+type NodeStats struct {
+	Active   bool `json:"active"`
+	Syncing  bool `json:"syncing"`
+	Mining   bool `json:"mining"`
+	Hashrate int  `json:"hashrate"`
+	Peers    int  `json:"peers"`
+	GasPrice int  `json:"gasPrice"`
+	Uptime   int  `json:"uptime"`
+}
+
+// BlockReport is the message sent by the node when a new block is imported
+type BlockReport struct {
+	ID    string     `json:"id"`
+	Block BlockStats `json:"block"`
+}
+
+// HistoryReport is the message sent by the node with a list of past blocks
+type HistoryReport struct {
+	ID      string       `json:"id"`
+	History []BlockStats `json:"history"`
+}
+
+// PendingReport is the message sent by the node with its pending transactions
+type PendingReport struct {
+	ID    string       `json:"id"`
+	Stats PendingStats `json:"stats"`
+}
+
+// StatsReport is the message sent by the node with its status
+type StatsReport struct {
+	ID    string    `json:"id"`
+	Stats NodeStats `json:"stats"`
+}
+
+// LatencyReport is the message sent by the node with the latency, in
+// milliseconds, between the node and this server
+type LatencyReport struct {
+	ID      string `json:"id"`
+	Latency string `json:"latency"`
+}
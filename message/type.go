@@ -2,32 +2,156 @@ package message
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 )
 
+// MaxSize is the maximum size, in bytes, of a message sent by a node
+const MaxSize int = 8 << 20
+
+var (
+	// ErrTooLarge is returned when the message is bigger than MaxSize
+	ErrTooLarge = errors.New("message too large")
+
+	// ErrNoType is returned when the message doesn't contain a valid type
+	ErrNoType = errors.New("message without type")
+
+	// ErrNoValue is returned when decoding a message without emitted value
+	ErrNoValue = errors.New("message without value")
+
+	// ErrUnknownType is returned when decoding a message type not known by this server
+	ErrUnknownType = errors.New("unknown message type")
+)
+
+// DecodeError is returned when the content of a message isn't valid JSON or
+// doesn't match the struct of its type
+type DecodeError struct {
+	// Type of the message, empty if the frame itself can't be decoded
+	Type string
+	Err  error
+}
+
+// Error return the description of the decode error
+func (d *DecodeError) Error() string {
+	if d.Type == "" {
+		return fmt.Sprintf("malformed message: %s", d.Err)
+	}
+	return fmt.Sprintf("malformed %s message: %s", d.Type, d.Err)
+}
+
+// frame is the envelope of all messages sent by the nodes
+type frame struct {
+	Emit []json.RawMessage `json:"emit"`
+}
+
 // Message contains the Ethereum message
 type Message struct {
+	// Content is the raw message sent by the node
 	Content []byte
+
+	// Type of the message, the first emitted element
+	Type string
+
+	// Value is the raw JSON of the second emitted element, nil if the
+	// message doesn't contain a value. A null value is kept as it is
+	Value json.RawMessage
 }
 
-// GetType return the type of the message sent by the Ethereum node
-func (e *Message) GetType() (string, error) {
-	var content map[string][]interface{}
-	err := json.Unmarshal([]byte(e.Content), &content)
-	if err != nil {
-		return "", err
+// Parse decodes the envelope of the message sent by the Ethereum node. The
+// content is decoded only once, the value is kept raw until Decode is called
+func Parse(content []byte) (*Message, error) {
+	if len(content) > MaxSize {
+		return nil, ErrTooLarge
+	}
+	var f frame
+	if err := json.Unmarshal(content, &f); err != nil {
+		return nil, &DecodeError{Err: err}
+	}
+	if len(f.Emit) == 0 {
+		return nil, ErrNoType
+	}
+	msg := &Message{Content: content}
+	if err := json.Unmarshal(f.Emit[0], &msg.Type); err != nil || msg.Type == "" {
+		return nil, ErrNoType
+	}
+	if len(f.Emit) > 1 {
+		msg.Value = f.Emit[1]
+	}
+	return msg, nil
+}
+
+// Decode decodes the emitted value into the struct of its message type. The
+// result is one of *AuthMessage, *NodePing, *BlockReport, *HistoryReport,
+// *PendingReport, *StatsReport or *LatencyReport
+func (e *Message) Decode() (interface{}, error) {
+	var result interface{}
+	switch e.Type {
+	case TypeHello:
+		result = &AuthMessage{}
+	case TypePing:
+		result = &NodePing{}
+	case TypeBlock:
+		result = &BlockReport{}
+	case TypeHistory:
+		result = &HistoryReport{}
+	case TypePending:
+		result = &PendingReport{}
+	case TypeStats:
+		result = &StatsReport{}
+	case TypeLatency:
+		result = &LatencyReport{}
+	default:
+		return nil, ErrUnknownType
+	}
+	if len(e.Value) == 0 || string(e.Value) == "null" {
+		return nil, ErrNoValue
+	}
+	if err := json.Unmarshal(e.Value, result); err != nil {
+		return nil, &DecodeError{Type: e.Type, Err: err}
 	}
-	result, _ := content["emit"][0].(string)
 	return result, nil
 }
 
-// GetValue retrieve the current content of the emitted message by the node
-func (e *Message) GetValue() ([]byte, error) {
-	var content map[string][]interface{}
-	err := json.Unmarshal([]byte(e.Content), &content)
+// errNotObject is returned when the id of a value that isn't an object is replaced
+var errNotObject = errors.New("value is not an object")
+
+// SetID replaces the node id reported in the emitted value, updating the
+// content of the message
+func (e *Message) SetID(id string) error {
+	var value map[string]json.RawMessage
+	if err := json.Unmarshal(e.Value, &value); err != nil {
+		return &DecodeError{Type: e.Type, Err: err}
+	}
+	if value == nil {
+		return &DecodeError{Type: e.Type, Err: errNotObject}
+	}
+	rawID, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	value["id"] = rawID
+	msg, err := New(e.Type, value)
+	if err != nil {
+		return err
+	}
+	*e = *msg
+	return nil
+}
+
+// New creates a new message with the given type and value, encoded like the
+// messages emitted by the nodes
+func New(msgType string, value interface{}) (*Message, error) {
+	rawValue, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	rawType, err := json.Marshal(msgType)
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(frame{Emit: []json.RawMessage{rawType, rawValue}})
 	if err != nil {
 		return nil, err
 	}
-	result, _ := content["emit"][1].(interface{})
-	val, err := json.Marshal(result)
-	return val, err
+	return &Message{Content: content, Type: msgType, Value: rawValue}, nil
 }
@@ -0,0 +1,161 @@
+package message
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// malformed are frames that nodes could send to crash the parser
+var malformed = []string{
+	`{"emit":[]}`,
+	`{"emit":["x"]}`,
+	`{"emit":"x"}`,
+	`null`,
+	`{"emit":["block",null]}`,
+	`{"emit":[null,{}]}`,
+	`{"emit":["",{}]}`,
+	`{"emit":[1,{}]}`,
+	`{"emit":["block",{"block":"x"}]}`,
+	`{"emit":["stats",[]]}`,
+	`{`,
+	``,
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		err     error
+	}{
+		{`{"emit":[]}`, ErrNoType},
+		{`{}`, ErrNoType},
+		{`null`, ErrNoType},
+		{`{"emit":[null,{}]}`, ErrNoType},
+		{`{"emit":["",{}]}`, ErrNoType},
+		{`{"emit":[1,{}]}`, ErrNoType},
+	}
+	for _, test := range tests {
+		if _, err := Parse([]byte(test.content)); err != test.err {
+			t.Errorf("Parse(%s) error = %v, want %v", test.content, err, test.err)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, content := range []string{`{"emit":"x"}`, `{`, ``, `[1,2]`} {
+		_, err := Parse([]byte(content))
+		if _, ok := err.(*DecodeError); !ok {
+			t.Errorf("Parse(%s) error = %v, want *DecodeError", content, err)
+		}
+	}
+}
+
+func TestParseTooLarge(t *testing.T) {
+	content := []byte(`{"emit":["stats","` + strings.Repeat("x", MaxSize) + `"]}`)
+	if _, err := Parse(content); err != ErrTooLarge {
+		t.Errorf("Parse error = %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		err     error
+	}{
+		{`{"emit":["block"]}`, ErrNoValue},
+		{`{"emit":["block",null]}`, ErrNoValue},
+		{`{"emit":["x",{}]}`, ErrUnknownType},
+	}
+	for _, test := range tests {
+		msg, err := Parse([]byte(test.content))
+		if err != nil {
+			t.Fatalf("Parse(%s) error = %v", test.content, err)
+		}
+		if _, err := msg.Decode(); err != test.err {
+			t.Errorf("Decode(%s) error = %v, want %v", test.content, err, test.err)
+		}
+	}
+	for _, content := range []string{`{"emit":["block",{"block":"x"}]}`, `{"emit":["stats",[]]}`, `{"emit":["hello",1]}`} {
+		msg, err := Parse([]byte(content))
+		if err != nil {
+			t.Fatalf("Parse(%s) error = %v", content, err)
+		}
+		if _, err := msg.Decode(); err == nil {
+			t.Errorf("Decode(%s) succeeded, want *DecodeError", content)
+		} else if e, ok := err.(*DecodeError); !ok || e.Type != msg.Type {
+			t.Errorf("Decode(%s) error = %v, want *DecodeError of type %s", content, err, msg.Type)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	msg, err := Parse([]byte(`{"emit":["block",{"id":"node","block":{"number":10}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := msg.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, ok := value.(*BlockReport)
+	if !ok || report.ID != "node" || report.Block.Number != 10 {
+		t.Errorf("Decode = %+v, want block 10 of node", value)
+	}
+}
+
+func TestSetIDInvalidValue(t *testing.T) {
+	for _, content := range []string{`{"emit":["stats",null]}`, `{"emit":["stats"]}`, `{"emit":["stats",[]]}`, `{"emit":["stats",1]}`} {
+		msg, err := Parse([]byte(content))
+		if err != nil {
+			t.Fatalf("Parse(%s) error = %v", content, err)
+		}
+		if _, ok := msg.SetID("node-2").(*DecodeError); !ok {
+			t.Errorf("SetID of %s didn't return a *DecodeError", content)
+		}
+	}
+}
+
+func TestSetID(t *testing.T) {
+	msg, err := Parse([]byte(`{"emit":["stats",{"id":"node","stats":{"peers":2}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.SetID("node-2"); err != nil {
+		t.Fatal(err)
+	}
+	value, err := msg.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := value.(*StatsReport); report.ID != "node-2" || report.Stats.Peers != 2 {
+		t.Errorf("SetID = %+v, want node-2 with 2 peers", report)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, content := range malformed {
+		f.Add([]byte(content))
+	}
+	f.Add([]byte(`{"emit":["hello",{"id":"node","secret":"s","info":{}}]}`))
+	f.Add([]byte(`{"emit":["node-ping",{"id":"node","clientTime":"now"}]}`))
+	f.Add([]byte(`{"emit":["history",{"id":"node","history":[{"number":1}]}]}`))
+	f.Fuzz(func(t *testing.T, content []byte) {
+		msg, err := Parse(content)
+		if err != nil {
+			if msg != nil {
+				t.Errorf("Parse returned a message and error %v", err)
+			}
+			return
+		}
+		if msg.Type == "" || !bytes.Equal(msg.Content, content) {
+			t.Errorf("Parse returned an invalid message %+v", msg)
+		}
+		value, err := msg.Decode()
+		if err == nil && value == nil {
+			t.Error("Decode returned neither a value nor an error")
+		}
+		if err := msg.SetID("node-2"); err == nil && msg.Type == "" {
+			t.Error("SetID lost the message type")
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// labelEscaper escapes the label values as required by the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// exposition builds a document in the Prometheus text exposition format
+type exposition struct {
+	buf bytes.Buffer
+}
+
+// family writes the help and type of a metric family
+func (e *exposition) family(name, kind, help string) {
+	e.buf.WriteString("# HELP " + name + " " + help + "\n")
+	e.buf.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// sample writes a sample of the metric with the given label pairs
+func (e *exposition) sample(name string, value float64, labels ...string) {
+	e.buf.WriteString(name)
+	if len(labels) > 0 {
+		e.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			e.buf.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		e.buf.WriteByte('}')
+	}
+	e.buf.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// counters writes a counter family with a sample for each key of the map,
+// using the key as the value of the given label
+func (e *exposition) counters(name, help, label string, values map[string]uint64) {
+	e.family(name, "counter", help)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		e.sample(name, float64(values[key]), label, key)
+	}
+}
+
+// bytes return the built document
+func (e *exposition) bytes() []byte {
+	return e.buf.Bytes()
+}
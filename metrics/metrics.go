@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/eskoltech/ethstats-server/broadcast"
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/relay"
+	"github.com/eskoltech/ethstats-server/service"
+)
+
+// Path is the endpoint where the metrics are served
+const Path string = "/metrics"
+
+// nodeGauge is a gauge with a sample for each node
+type nodeGauge struct {
+	name string
+	help string
+}
+
+// nodeGauges are the gauges computed from the last reports of each node
+var nodeGauges = []nodeGauge{
+	{"ethstats_node_up", "Whether the node is connected to the server"},
+	{"ethstats_node_head_block", "Number of the last block reported by the node"},
+	{"ethstats_node_peers", "Number of peers of the node"},
+	{"ethstats_node_pending_transactions", "Number of pending transactions of the node"},
+	{"ethstats_node_latency_milliseconds", "Latency between the node and the server"},
+	{"ethstats_node_propagation_milliseconds", "Propagation delay of the last block reported by the node"},
+	{"ethstats_node_syncing", "Whether the node is syncing"},
+	{"ethstats_node_mining", "Whether the node is mining"},
+	{"ethstats_node_hashrate", "Hashrate reported by the node"},
+}
+
+// Handler serves the metrics of the nodes and the server in the Prometheus
+// text exposition format
+type Handler struct {
+	service *service.Channel
+	relay   *relay.NodeRelay
+	server  *broadcast.Server
+}
+
+// New creates a new Handler that reads the nodes from the service and the
+// counters from the node relay and the broadcast server
+func New(service *service.Channel, relay *relay.NodeRelay, server *broadcast.Server) *Handler {
+	defer func() { service.Log().Info("Metrics exporter started successfully") }()
+	return &Handler{service: service, relay: relay, server: server}
+}
+
+// ServeHTTP writes the current metrics
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var e exposition
+	h.writeNodes(&e)
+	h.writeServer(&e)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(e.bytes())
+}
+
+// writeNodes writes the gauges of all registered nodes. Gauges without a
+// value for a node, because it never reported it, are skipped
+func (h *Handler) writeNodes(e *exposition) {
+	nodes := h.service.Nodes.Snapshot()
+	values := make([]map[string]float64, len(nodes))
+	for i, node := range nodes {
+		values[i] = nodeValues(node)
+	}
+	for _, gauge := range nodeGauges {
+		e.family(gauge.name, "gauge", gauge.help)
+		for i, node := range nodes {
+			if value, ok := values[i][gauge.name]; ok {
+				e.sample(gauge.name, value, "node", node.ID)
+			}
+		}
+	}
+}
+
+// writeServer writes the metrics of the relay and the broadcast server
+func (h *Handler) writeServer(e *exposition) {
+	relayStats := h.relay.Stats()
+	serverStats := h.server.Stats()
+
+	e.family("ethstats_connected_nodes", "gauge", "Number of nodes connected to the server")
+	e.sample("ethstats_connected_nodes", float64(h.service.Nodes.Len()))
+	e.family("ethstats_dashboard_clients", "gauge", "Number of dashboard clients connected to the server")
+	e.sample("ethstats_dashboard_clients", float64(serverStats.Clients))
+	e.counters("ethstats_messages_received_total", "Messages received from the nodes", "type", relayStats.Received)
+	e.counters("ethstats_messages_broadcast_total", "Messages broadcast to the dashboard clients", "type", serverStats.Broadcast)
+	e.family("ethstats_messages_sent_total", "counter", "Messages written to the dashboard clients")
+	e.sample("ethstats_messages_sent_total", float64(serverStats.Sent))
+	e.family("ethstats_broadcasts_dropped_total", "counter", "Messages dropped because the queue of a client was full")
+	e.sample("ethstats_broadcasts_dropped_total", float64(serverStats.Dropped))
+	e.family("ethstats_broadcasts_coalesced_total", "counter", "Queued messages replaced by newer ones")
+	e.sample("ethstats_broadcasts_coalesced_total", float64(serverStats.Coalesced))
+	e.family("ethstats_clients_evicted_total", "counter", "Clients disconnected because their queue was full")
+	e.sample("ethstats_clients_evicted_total", float64(serverStats.Evicted))
+	e.family("ethstats_auth_failures_total", "counter", "Nodes that failed to authenticate")
+	e.sample("ethstats_auth_failures_total", float64(relayStats.AuthFailures))
+}
+
+// nodeValues return the value of each node gauge, using the last messages
+// reported by the node
+func nodeValues(node service.Node) map[string]float64 {
+	values := map[string]float64{"ethstats_node_up": boolValue(node.Active)}
+	for msgType, content := range node.Latest {
+		msg, err := message.Parse(content)
+		if err != nil {
+			continue
+		}
+		if msgType == message.TypePropagation {
+			var report message.PropagationReport
+			if err := json.Unmarshal(msg.Value, &report); err == nil {
+				values["ethstats_node_propagation_milliseconds"] = float64(report.Propagation)
+			}
+			continue
+		}
+		value, err := msg.Decode()
+		if err != nil {
+			continue
+		}
+		switch v := value.(type) {
+		case *message.BlockReport:
+			values["ethstats_node_head_block"] = float64(v.Block.Number)
+		case *message.PendingReport:
+			values["ethstats_node_pending_transactions"] = float64(v.Stats.Pending)
+		case *message.LatencyReport:
+			if latency, err := strconv.ParseFloat(v.Latency, 64); err == nil {
+				values["ethstats_node_latency_milliseconds"] = latency
+			}
+		case *message.StatsReport:
+			values["ethstats_node_peers"] = float64(v.Stats.Peers)
+			values["ethstats_node_syncing"] = boolValue(v.Stats.Syncing)
+			values["ethstats_node_mining"] = boolValue(v.Stats.Mining)
+			values["ethstats_node_hashrate"] = float64(v.Stats.Hashrate)
+		}
+	}
+	return values
+}
+
+// boolValue return 1 if the value is true, otherwise 0
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,28 @@
+package relay
+
+import (
+	"crypto/subtle"
+
+	"github.com/eskoltech/ethstats-server/message"
+)
+
+// Authenticator decides which nodes can report stats to this server
+type Authenticator interface {
+	// Authenticate return an error if the node that sent the hello message
+	// can't report stats
+	Authenticate(hello *message.AuthMessage) error
+}
+
+// SecretAuthenticator accepts the nodes that send the given secret in the
+// hello message
+type SecretAuthenticator string
+
+// Authenticate return an error if the secret sent by the node is wrong. The
+// secrets are compared in constant time, so the time taken doesn't tell how
+// much of the secret is right
+func (s SecretAuthenticator) Authenticate(hello *message.AuthMessage) error {
+	if subtle.ConstantTimeCompare([]byte(hello.Secret), []byte(s)) != 1 {
+		return errInvalidSecret
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package relay
+
+import (
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+)
+
+// requestHistory asks the node for the blocks missing in the history of the
+// network, up to its own head. Nodes that can't send their history are never
+// asked, and each node is asked at most once per history interval
+func (n *NodeRelay) requestHistory(s *session) {
+	if !s.history || n.historyLimit <= 0 || n.service.Gaps == nil {
+		return
+	}
+	if !s.requested.IsZero() && time.Since(s.requested) < n.historyInterval {
+		return
+	}
+	missing := n.service.Gaps.Missing(s.head, n.historyLimit)
+	if len(missing) == 0 {
+		return
+	}
+	request := &message.HistoryRequest{List: missing}
+	if err := request.SendRequest(s.conn); err != nil {
+		n.service.Log().Errorf("Error sending history request to node[%s], error: %s", s.id, err)
+		return
+	}
+	s.requested = time.Now()
+	n.service.Log().Infof("Requested %d blocks of history to node[%s] (%d-%d)", len(missing), s.id, missing[0], missing[len(missing)-1])
+}
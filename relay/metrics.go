@@ -0,0 +1,45 @@
+package relay
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats contains the counters of the messages received from the nodes
+type Stats struct {
+	// Received is the number of messages received from the nodes, by type
+	Received map[string]uint64
+
+	// AuthFailures is the number of nodes that failed to authenticate
+	AuthFailures uint64
+}
+
+// metrics are the counters of the relay, safe for concurrent use
+type metrics struct {
+	lock         sync.Mutex
+	received     map[string]uint64
+	authFailures uint64
+}
+
+// receive counts a message of the given type received from a node
+func (m *metrics) receive(msgType string) {
+	m.lock.Lock()
+	m.received[msgType]++
+	m.lock.Unlock()
+}
+
+// authFailed counts a node that failed to authenticate
+func (m *metrics) authFailed() {
+	atomic.AddUint64(&m.authFailures, 1)
+}
+
+// stats return a copy of the current counters
+func (m *metrics) stats() Stats {
+	m.lock.Lock()
+	received := make(map[string]uint64, len(m.received))
+	for msgType, count := range m.received {
+		received[msgType] = count
+	}
+	m.lock.Unlock()
+	return Stats{Received: received, AuthFailures: atomic.LoadUint64(&m.authFailures)}
+}
@@ -1,27 +1,27 @@
 package relay
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/eskoltech/ethstats-server/journal"
 	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/sanitize"
 	"github.com/eskoltech/ethstats-server/service"
 	"github.com/gorilla/websocket"
-	log "github.com/sirupsen/logrus"
 )
 
-const (
-	// Api is the public endpoint used to send stats from nodes to this server
-	Api            string = "/api"
-	messageHello   string = "hello"
-	messagePing    string = "node-ping"
-	messageLatency string = "latency"
-	messageBlock   string = "block"
-	messageHistory string = "history"
-	messagePending string = "pending"
-	messageStats   string = "stats"
-)
+// Api is the public endpoint used to send stats from nodes to this server
+const Api string = "/api"
+
+// errInvalidSecret is returned when a node sends a hello message with a wrong secret
+var errInvalidSecret = errors.New("invalid secret")
 
 // upgradeConnection upgrade only HTTP request to the /api endpoint
 var upgradeConnection = websocket.Upgrader{
@@ -30,142 +30,411 @@ var upgradeConnection = websocket.Upgrader{
 	},
 }
 
+// Config contains the settings used by the node relay
+type Config struct {
+	// Secret used to authenticate the Ethereum nodes, only if Auth is nil
+	Secret string
+
+	// Auth decides which nodes can report stats. If nil, nodes are
+	// authenticated using the secret
+	Auth Authenticator
+
+	// AuthTimeout is the maximum time a node has to send a valid hello message
+	// after connecting. If zero, nodes can stay unauthenticated forever
+	AuthTimeout time.Duration
+
+	// InactiveTimeout is the maximum time an authenticated node can stay
+	// without sending messages. If zero, nodes are never considered inactive
+	InactiveTimeout time.Duration
+
+	// Sanitizer rewrites node messages before they are published. If nil, a
+	// sanitizer that only strips node credentials is used
+	Sanitizer *sanitize.Sanitizer
+
+	// HistoryLimit is the maximum number of blocks requested to a node in a
+	// single history request. If zero, history is never requested
+	HistoryLimit int
+
+	// HistoryInterval is the minimum time between two history requests sent
+	// to the same node
+	HistoryInterval time.Duration
+
+	// Journal records every frame received from the nodes. If nil, the
+	// traffic isn't recorded
+	Journal *journal.Writer
+}
+
 // NodeRelay contains the secret used to authenticate the communication between
 // the Ethereum node and this server
 type NodeRelay struct {
-	secret  string
-	service *service.Channel
+	auth            Authenticator
+	authTimeout     time.Duration
+	inactiveTimeout time.Duration
+	sanitizer       *sanitize.Sanitizer
+	historyLimit    int
+	historyInterval time.Duration
+	metrics         *metrics
+	journal         *journal.Writer
+	connections     uint64
+	service         *service.Channel
+
+	// sessions are the open node connections, tracked so they can be closed
+	// when the relay is closed
+	lock     sync.Mutex
+	sessions map[*session]struct{}
+	closed   bool
+	wg       sync.WaitGroup
 }
 
 // New creates a new NodeRelay struct with required fields
-func New(service *service.Channel, secret string) *NodeRelay {
-	defer func() { log.Info("Node relay started successfully") }()
+func New(service *service.Channel, config Config) *NodeRelay {
+	defer func() { service.Log().Info("Node relay started successfully") }()
+	sanitizer := config.Sanitizer
+	if sanitizer == nil {
+		sanitizer = sanitize.New()
+	}
+	auth := config.Auth
+	if auth == nil {
+		auth = SecretAuthenticator(config.Secret)
+	}
 	return &NodeRelay{
-		service: service,
-		secret:  secret,
+		service:         service,
+		auth:            auth,
+		authTimeout:     config.AuthTimeout,
+		inactiveTimeout: config.InactiveTimeout,
+		sanitizer:       sanitizer,
+		historyLimit:    config.HistoryLimit,
+		historyInterval: config.HistoryInterval,
+		metrics:         &metrics{received: make(map[string]uint64)},
+		journal:         config.Journal,
+		sessions:        make(map[*session]struct{}),
 	}
 }
 
-// Close closes the connection between this server and all Ethereum nodes connected to it
+// Stats return the counters of the messages received from the nodes
+func (n *NodeRelay) Stats() Stats {
+	return n.metrics.stats()
+}
+
+// Close closes the connection between this server and all Ethereum nodes
+// connected to it, and waits until their messages are published. New nodes
+// are rejected after the relay is closed
 func (n *NodeRelay) Close() {
-	log.Info("Prepared to close connection with nodes...")
+	n.service.Log().Info("Prepared to close connection with nodes...")
+	n.lock.Lock()
+	n.closed = true
+	sessions := make([]*session, 0, len(n.sessions))
+	for s := range n.sessions {
+		sessions = append(sessions, s)
+	}
+	n.lock.Unlock()
+	for _, s := range sessions {
+		s.Close()
+	}
+	n.wg.Wait()
 	close(n.service.Message)
 }
 
+// track adds the session to the open ones. If the relay is closed, false is
+// returned and the session must be closed
+func (n *NodeRelay) track(s *session) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return false
+	}
+	n.sessions[s] = struct{}{}
+	n.wg.Add(1)
+	return true
+}
+
+// untrack removes the session from the open ones
+func (n *NodeRelay) untrack(s *session) {
+	n.lock.Lock()
+	delete(n.sessions, s)
+	n.lock.Unlock()
+	n.wg.Done()
+}
+
+// closing return true if the relay is being closed
+func (n *NodeRelay) closing() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.closed
+}
+
 // HandleRequest is the function to handle all server requests that came from
 // Ethereum nodes
 func (n *NodeRelay) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	nodeConn, err := upgradeConnection.Upgrade(w, r, nil)
 	if err != nil {
-		log.Warningf("Error establishing node connection: %s", err)
+		n.service.Log().Warningf("Error establishing node connection: %s", err)
 		return
 	}
-	log.Infof("New Ethereum node connected! (addr=%s, host=%s)", r.RemoteAddr, r.Host)
-	go n.loop(nodeConn)
+	n.service.Log().Infof("New Ethereum node connected! (addr=%s, host=%s)", r.RemoteAddr, r.Host)
+	// the node must authenticate before the deadline, otherwise the read
+	// fails and the connection is closed
+	nodeConn.SetReadLimit(int64(message.MaxSize))
+	if n.authTimeout > 0 {
+		nodeConn.SetReadDeadline(time.Now().Add(n.authTimeout))
+	}
+	s := newSession(nodeConn, atomic.AddUint64(&n.connections, 1))
+	if !n.track(s) {
+		s.Close()
+		return
+	}
+	go n.loop(s)
 }
 
 // loop loops as long as the connection is alive and retrieves node packages
-func (n *NodeRelay) loop(c *websocket.Conn) {
-	// Close connection if an unexpected error occurs and delete the node
-	// from the map of connected nodes...
-	defer func(conn *websocket.Conn) {
-		delete(n.service.Nodes, conn.RemoteAddr().String())
-		err := conn.Close()
-		if err != nil {
-			log.Fatal(err)
+func (n *NodeRelay) loop(s *session) {
+	c := s.conn
+	addr := c.RemoteAddr().String()
+	n.emit(message.EventConnected, "", addr, "")
+
+	// reason why the connection was closed, sent to the clients when an
+	// authenticated node disconnects
+	reason := "connection closed"
+
+	// Close connection if an unexpected error occurs and mark the node as
+	// disconnected in the registry...
+	defer func(s *session) {
+		n.record(journal.Entry{Time: time.Now(), Conn: s.serial, Node: s.id, Closed: true})
+		// a replaced node is still connected using the new connection, so
+		// the clients aren't told it disconnected
+		if s.id != "" && n.service.Nodes.Disconnect(s.id, s) {
+			n.emit(message.EventDisconnected, s.id, addr, reason)
+		}
+		if err := s.Close(); err != nil {
+			n.service.Log().Warningf("Can't close connection with %s, error: %s", addr, err)
 		}
-		log.Warningf("Connection with node closed, there are %d connected nodes", len(n.service.Nodes))
-	}(c)
+		n.service.Log().Warningf("Connection with node closed, there are %d connected nodes", n.service.Nodes.Len())
+		n.untrack(s)
+	}(s)
 	// Client loop
 	for {
 		_, content, err := c.ReadMessage()
 		if err != nil {
-			log.Errorf("Error reading message from client, %s", err)
+			netErr, ok := err.(net.Error)
+			timeout := ok && netErr.Timeout()
+			switch {
+			case n.closing():
+				reason = "server closed"
+			case s.current() == stateClosed:
+				n.service.Log().Warningf("Node[%s] replaced by a new connection", s.id)
+			case timeout && !s.authenticated():
+				n.service.Log().Warningf("Node didn't authenticate in %s, closing connection (addr=%s)", n.authTimeout, addr)
+				n.metrics.authFailed()
+				n.emit(message.EventAuthFailed, "", addr, "authentication timeout")
+			case timeout:
+				n.service.Log().Warningf("Node[%s] didn't report in %s, closing connection", s.id, n.inactiveTimeout)
+				reason = "inactive"
+				n.emit(message.EventInactive, s.id, addr, fmt.Sprintf("no messages in %s", n.inactiveTimeout))
+			default:
+				n.service.Log().Errorf("Error reading message from client, %s", err)
+				reason = err.Error()
+			}
 			break
 		}
+		n.record(journal.Entry{Time: time.Now(), Conn: s.serial, Node: s.id, Frame: string(content)})
+
 		// Create emitted message from the node
-		msg := message.Message{Content: content}
-		msgType, err := msg.GetType()
+		msg, err := message.Parse(content)
 		if err != nil {
-			log.Warningf("Can't get type of message sent by the node: %s", err)
+			n.service.Log().Warningf("Can't parse message sent by the node: %s", err)
+			reason = err.Error()
 			return
 		}
+		msgType := msg.Type
+		n.metrics.receive(msgType)
 
 		// If message type is hello, we need to check if the secret is
 		// correct, and then, send a ready message
-		if msgType == messageHello {
-			// Get value from JSON to store it and process it later to calculate
-			// node latency etc
-			authMsg, parseError := parseAuthMessage(msg)
-			if parseError != nil {
-				log.Warningf("Can't parse authorization message sent by node[%s], error: %s", authMsg.ID, parseError)
-				return
-			}
-			// first check if the secret is correct
-			if authMsg.Secret != n.secret {
-				log.Errorf("Invalid secret from node %s, can't get stats", authMsg.ID)
-				return
+		if msgType == message.TypeHello {
+			if s.authenticated() {
+				n.service.Log().Warningf("Node[%s] is already authenticated, ignoring hello message", s.id)
+				continue
 			}
-			sendError := authMsg.SendResponse(c)
-			if sendError != nil {
-				log.Errorf("Error sending authorization response to node[%s], error: %s", authMsg.ID, sendError)
+			if err := n.authenticate(s, msg); err != nil {
+				if !s.authenticated() {
+					n.metrics.authFailed()
+					n.emit(message.EventAuthFailed, "", addr, err.Error())
+				}
+				reason = err.Error()
 				return
 			}
-			n.service.Message <- content
+			n.emit(message.EventAuthenticated, s.id, addr, "")
+			n.extendDeadline(c)
+			n.requestHistory(s)
+			n.service.Log().Infof("Currently there are %d connected nodes", n.service.Nodes.Len())
+			continue
+		}
 
-			// use node addr as identifier to check node availability
-			n.service.Nodes[c.RemoteAddr().String()] = content
-			log.Infof("Currently there are %d connected nodes", len(n.service.Nodes))
+		// Any other message is dropped until the node is authenticated
+		if !s.authenticated() {
+			n.service.Log().Warningf("Dropped %s message from unauthenticated node (addr=%s)", msgType, addr)
+			continue
 		}
+		n.service.Nodes.Touch(s.id)
+		n.extendDeadline(c)
 
 		// When the node emit a ping message, we need to respond with pong
 		// before five seconds to authorize that node to sent reports
-		if msgType == messagePing {
-			ping, err := parseNodePingMessage(msg)
+		if msgType == message.TypePing {
+			value, err := msg.Decode()
 			if err != nil {
-				log.Warningf("Can't parse ping message sent by node[%s], error: %s", ping.ID, err)
+				n.service.Log().Warningf("Can't parse ping message sent by node[%s], error: %s", s.id, err)
+				reason = err.Error()
 				return
 			}
+			ping := value.(*message.NodePing)
 			sendError := ping.SendResponse(c)
 			if sendError != nil {
-				log.Errorf("Error sending pong response to node[%s], error: %s", ping.ID, sendError)
+				n.service.Log().Errorf("Error sending pong response to node[%s], error: %s", s.id, sendError)
+			}
+			if _, err := n.publish(s, msg); err != nil {
+				n.service.Log().Warningf("Can't sanitize ping message sent by node[%s], error: %s", s.id, err)
 			}
-			n.service.Message <- content
 		}
 
-		// Send the content sent by the nodes directly to the consumer clients.
-		// Only message types recognized by this server
+		// Send the content sent by the nodes to the consumer clients. Only
+		// message types recognized by this server
 		if isValidMessage(msgType) {
-			n.service.Message <- content
+			content, err := n.publish(s, msg)
+			if err != nil {
+				n.service.Log().Warningf("Can't sanitize %s message sent by node[%s], error: %s", msgType, s.id, err)
+				continue
+			}
+			// keep the last report so new clients receive the current state
+			n.service.Nodes.SetLatest(s.id, msgType, content)
+			n.consume(s, msg)
+			if msgType == message.TypeBlock {
+				n.requestHistory(s)
+			}
 		}
 	}
 }
 
-// isValidMessage return true if the message type is know, otherwise return false
-func isValidMessage(msgType string) bool {
-	return msgType == messageLatency || msgType == messageBlock || msgType == messageHistory || msgType == messagePending || msgType == messageStats
+// consume decodes the message and hands it to all the consumers of node reports
+func (n *NodeRelay) consume(s *session, msg *message.Message) {
+	if len(n.service.Consumers) == 0 {
+		return
+	}
+	value, err := msg.Decode()
+	if err != nil {
+		n.service.Log().Warningf("Can't decode %s message sent by node[%s], error: %s", msg.Type, s.id, err)
+		return
+	}
+	if report, ok := value.(*message.BlockReport); ok && report.Block.Number > s.head {
+		s.head = report.Block.Number
+	}
+	received := time.Now()
+	for _, consumer := range n.service.Consumers {
+		consumer.Consume(s.id, value, received)
+	}
+}
+
+// authenticate checks the secret of the hello message sent by the node and
+// registers it. If the node is valid, the ready message is sent to the node
+// and the hello message is published
+func (n *NodeRelay) authenticate(s *session, msg *message.Message) error {
+	c := s.conn
+	// Get value from JSON to store it and process it later to calculate
+	// node latency etc
+	value, err := msg.Decode()
+	if err != nil {
+		n.service.Log().Warningf("Can't parse authorization message sent by node (addr=%s), error: %s", c.RemoteAddr(), err)
+		return err
+	}
+	authMsg := value.(*message.AuthMessage)
+	// first check if the node can report stats
+	if err := n.auth.Authenticate(authMsg); err != nil {
+		n.service.Log().Errorf("Node %s can't get stats, %s", authMsg.ID, err)
+		return err
+	}
+	// register the node using the id it reports, so the node keeps
+	// its history and counters across reconnections
+	id, err := n.service.Nodes.Connect(authMsg.ID, s)
+	if err != nil {
+		n.service.Log().Errorf("Can't register node[%s], error: %s", authMsg.ID, err)
+		return err
+	}
+	s.history = authMsg.Info.History
+	if err := s.authenticate(id, authMsg.ID); err != nil {
+		n.service.Nodes.Disconnect(id, s)
+		n.service.Log().Errorf("Can't authenticate node[%s], session is %s", id, s.current())
+		return err
+	}
+	if id != authMsg.ID {
+		n.service.Log().Warningf("Node[%s] is already connected, registered as node[%s]", authMsg.ID, id)
+	}
+	err = authMsg.SendResponse(c)
+	if err != nil {
+		n.service.Log().Errorf("Error sending authorization response to node[%s], error: %s", id, err)
+		return err
+	}
+	content, err := n.publish(s, msg)
+	if err != nil {
+		n.service.Log().Errorf("Can't sanitize authorization message sent by node[%s], error: %s", id, err)
+		return err
+	}
+	n.service.Nodes.SetHello(id, content)
+	return nil
+}
+
+// record writes the entry to the journal, if the traffic is recorded
+func (n *NodeRelay) record(entry journal.Entry) {
+	if n.journal == nil {
+		return
+	}
+	if err := n.journal.Write(entry); err != nil {
+		n.service.Log().Warningf("Can't record traffic of node[%s], error: %s", entry.Node, err)
+	}
+}
+
+// extendDeadline gives an authenticated node more time to send the next
+// message before it's considered inactive
+func (n *NodeRelay) extendDeadline(c *websocket.Conn) {
+	if n.inactiveTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(n.inactiveTimeout))
+		return
+	}
+	c.SetReadDeadline(time.Time{})
 }
 
-// parseNodePingMessage parse the current ping message sent bu the Ethereum node
-// and creates a message.NodePing struct with that info
-func parseNodePingMessage(msg message.Message) (*message.NodePing, error) {
-	value, err := msg.GetValue()
+// emit sends a node lifecycle event to the consumer clients
+func (n *NodeRelay) emit(event, id, addr, reason string) {
+	msg, err := message.New(message.TypeNodeEvent, message.NewNodeEvent(event, id, addr, reason))
 	if err != nil {
-		return &message.NodePing{}, err
+		n.service.Log().Warningf("Can't create %s event for node (addr=%s), error: %s", event, addr, err)
+		return
 	}
-	var ping message.NodePing
-	err = json.Unmarshal(value, &ping)
-	return &ping, err
+	content, err := n.sanitizer.Sanitize(msg)
+	if err != nil {
+		n.service.Log().Warningf("Can't sanitize %s event for node (addr=%s), error: %s", event, addr, err)
+		return
+	}
+	n.service.Message <- service.Message{Content: content, Type: message.TypeNodeEvent, Node: id}
 }
 
-// parseAuthMessage parse the current byte array and transforms it to an AuthMessage struct.
-// If an error occurs when json unmarshal, an error is returned
-func parseAuthMessage(msg message.Message) (*message.AuthMessage, error) {
-	value, err := msg.GetValue()
+// publish sanitizes the message and sends it to the consumer clients. If the
+// node was registered using a different id, the id of the message is replaced.
+// The sanitized content is returned
+func (n *NodeRelay) publish(s *session, msg *message.Message) ([]byte, error) {
+	if s.id != s.reported {
+		if err := msg.SetID(s.id); err != nil {
+			return nil, err
+		}
+	}
+	sanitized, err := n.sanitizer.Sanitize(msg)
 	if err != nil {
-		return &message.AuthMessage{}, err
+		return nil, err
 	}
-	var detail message.AuthMessage
-	err = json.Unmarshal(value, &detail)
-	return &detail, err
+	n.service.Message <- service.Message{Content: sanitized, Type: msg.Type, Node: s.id}
+	return sanitized, nil
+}
+
+// isValidMessage return true if the message type is know, otherwise return false
+func isValidMessage(msgType string) bool {
+	return msgType == message.TypeLatency || msgType == message.TypeBlock || msgType == message.TypeHistory || msgType == message.TypePending || msgType == message.TypeStats
 }
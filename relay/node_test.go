@@ -0,0 +1,226 @@
+package relay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const testSecret = "s3cr3t"
+
+// testRelay starts a relay with the given config behind a test HTTP server,
+// and return it and the websocket endpoint of the nodes
+func testRelay(t *testing.T, config Config, policy service.DuplicatePolicy) (*NodeRelay, string) {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	channel := &service.Channel{
+		Message: make(chan service.Message, 64),
+		Nodes:   service.NewRegistry(policy),
+		Logger:  logger,
+	}
+	config.Secret = testSecret
+	relay := New(channel, config)
+	server := httptest.NewServer(http.HandlerFunc(relay.HandleRequest))
+	t.Cleanup(func() {
+		relay.Close()
+		server.Close()
+	})
+	return relay, "ws" + strings.TrimPrefix(server.URL, "http") + Api
+}
+
+// waitSessions waits until the relay has the given number of open sessions
+func waitSessions(t *testing.T, relay *NodeRelay, sessions int) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		relay.lock.Lock()
+		open := len(relay.sessions)
+		relay.lock.Unlock()
+		if open == sessions {
+			return
+		}
+	}
+	t.Fatalf("Relay didn't get to %d open sessions", sessions)
+}
+
+// dial connects a fake node to the relay
+func dial(t *testing.T, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// send writes a message of the given type to the relay
+func send(t *testing.T, conn *websocket.Conn, msgType string, value interface{}) {
+	msg, err := message.New(msgType, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, msg.Content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hello authenticates the node with the given id and secret, and waits for
+// the ready message if the secret is right
+func hello(t *testing.T, conn *websocket.Conn, id, secret string) {
+	send(t, conn, message.TypeHello, message.AuthMessage{ID: id, Secret: secret})
+	if secret != testSecret {
+		return
+	}
+	_, content, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := message.Parse(content); err != nil || msg.Type != "ready" {
+		t.Fatalf("Expected ready message after hello, got %s", content)
+	}
+}
+
+// published return the types of the messages published until a message of
+// the given type is published
+func published(t *testing.T, channel *service.Channel, until string) []string {
+	var types []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case published := <-channel.Message:
+			msg, err := message.Parse(published.Content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != published.Type {
+				t.Fatalf("Message published with type %s, content has %s", published.Type, msg.Type)
+			}
+			if msg.Type != message.TypeNodeEvent && published.Node == "" {
+				t.Fatalf("%s message published without node", msg.Type)
+			}
+			types = append(types, msg.Type)
+			if msg.Type == until {
+				return types
+			}
+		case <-timeout:
+			t.Fatalf("No %s message published, got %v", until, types)
+		}
+	}
+}
+
+// closed return true if the relay closes the connection before the deadline
+func closed(conn *websocket.Conn) bool {
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			netErr, ok := err.(interface{ Timeout() bool })
+			return !ok || !netErr.Timeout()
+		}
+	}
+}
+
+func TestUnauthenticatedMessagesNotPublished(t *testing.T) {
+	relay, url := testRelay(t, Config{}, service.RejectDuplicate)
+	channel := relay.service
+	conn := dial(t, url)
+	send(t, conn, message.TypeStats, message.StatsReport{ID: "node-1"})
+	send(t, conn, message.TypeBlock, message.BlockReport{ID: "node-1"})
+	hello(t, conn, "node-1", testSecret)
+	send(t, conn, message.TypePending, message.PendingReport{ID: "node-1"})
+	for _, msgType := range published(t, channel, message.TypePending) {
+		if msgType == message.TypeStats || msgType == message.TypeBlock {
+			t.Errorf("%s message sent before authenticating was published", msgType)
+		}
+	}
+}
+
+func TestWrongSecretClosesConnection(t *testing.T) {
+	relay, url := testRelay(t, Config{}, service.RejectDuplicate)
+	channel := relay.service
+	conn := dial(t, url)
+	hello(t, conn, "node-1", "wrong")
+	if !closed(conn) {
+		t.Fatal("Connection not closed after sending a wrong secret")
+	}
+	if _, ok := channel.Nodes.Get("node-1"); ok {
+		t.Error("Node with a wrong secret was registered")
+	}
+}
+
+func TestAuthTimeoutClosesConnection(t *testing.T) {
+	_, url := testRelay(t, Config{AuthTimeout: 100 * time.Millisecond}, service.RejectDuplicate)
+	conn := dial(t, url)
+	start := time.Now()
+	if !closed(conn) {
+		t.Fatal("Connection not closed after the authentication timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Connection closed after %s, want about 100ms", elapsed)
+	}
+}
+
+func TestSecondHelloIgnored(t *testing.T) {
+	relay, url := testRelay(t, Config{}, service.RejectDuplicate)
+	channel := relay.service
+	conn := dial(t, url)
+	hello(t, conn, "node-1", testSecret)
+	send(t, conn, message.TypeHello, message.AuthMessage{ID: "node-2", Secret: testSecret})
+	send(t, conn, message.TypePending, message.PendingReport{ID: "node-1"})
+	hellos := 0
+	for _, msgType := range published(t, channel, message.TypePending) {
+		if msgType == message.TypeHello {
+			hellos++
+		}
+	}
+	if hellos != 1 {
+		t.Errorf("Published %d hello messages, want 1", hellos)
+	}
+	if _, ok := channel.Nodes.Get("node-2"); ok {
+		t.Error("Second hello registered a new node")
+	}
+	if node, ok := channel.Nodes.Get("node-1"); !ok || !node.Active {
+		t.Error("Node not active after sending a second hello")
+	}
+}
+
+func TestReplacedNodeNotDisconnected(t *testing.T) {
+	relay, url := testRelay(t, Config{}, service.ReplaceDuplicate)
+	old := dial(t, url)
+	hello(t, old, "node-1", testSecret)
+	conn := dial(t, url)
+	hello(t, conn, "node-1", testSecret)
+	if !closed(old) {
+		t.Fatal("Replaced connection not closed")
+	}
+	waitSessions(t, relay, 1)
+	conn.Close()
+	waitSessions(t, relay, 0)
+
+	disconnected := 0
+	for len(relay.service.Message) > 0 {
+		msg, err := message.Parse((<-relay.service.Message).Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != message.TypeNodeEvent {
+			continue
+		}
+		var event message.NodeEvent
+		if err := json.Unmarshal(msg.Value, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Event == message.EventDisconnected {
+			disconnected++
+		}
+	}
+	if disconnected != 1 {
+		t.Errorf("Got %d disconnected events, want 1 for the new connection only", disconnected)
+	}
+}
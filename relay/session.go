@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessionState is the state of the communication between a node and this server
+type sessionState int
+
+const (
+	// stateConnected is the state of a node that opened a connection but has
+	// not sent a valid hello message yet
+	stateConnected sessionState = iota
+	// stateAuthenticated is the state of a node whose secret was verified
+	stateAuthenticated
+	// stateClosed is the state of a connection that can't be used anymore
+	stateClosed
+)
+
+// errInvalidTransition is returned when a session can't move to the requested state
+var errInvalidTransition = errors.New("invalid session state transition")
+
+// String return the name of the session state
+func (s sessionState) String() string {
+	switch s {
+	case stateConnected:
+		return "connected"
+	case stateAuthenticated:
+		return "authenticated"
+	case stateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// session holds the state of the connection with a single Ethereum node. Only
+// authenticated sessions are allowed to report stats to this server. Sessions
+// can be closed from other goroutines, i.e. when a node with the same id
+// replaces this one
+type session struct {
+	conn  *websocket.Conn
+	lock  sync.Mutex
+	state sessionState
+
+	// serial identifies the connection in the recorded traffic
+	serial uint64
+
+	// id is the id assigned to the node by the registry, and reported the id
+	// sent by the node. They are different only if the node id was suffixed
+	id       string
+	reported string
+
+	// history is true if the node can send past blocks on request, head is
+	// the highest block reported by the node, and requested the last time
+	// history was requested. Only used from the goroutine reading the node
+	history   bool
+	head      uint64
+	requested time.Time
+}
+
+// newSession creates a new session for the given connection, identified by the serial number
+func newSession(conn *websocket.Conn, serial uint64) *session {
+	return &session{conn: conn, state: stateConnected, serial: serial}
+}
+
+// authenticate moves the session to the authenticated state. Only sessions
+// that are connected can be authenticated
+func (s *session) authenticate(id, reported string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.state != stateConnected {
+		return errInvalidTransition
+	}
+	s.id = id
+	s.reported = reported
+	s.state = stateAuthenticated
+	return nil
+}
+
+// authenticated return true if the node sent a valid hello message
+func (s *session) authenticated() bool {
+	return s.current() == stateAuthenticated
+}
+
+// current return the current state of the session
+func (s *session) current() sessionState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+// Close closes the underlying connection and moves the session to the closed state
+func (s *session) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.state == stateClosed {
+		return nil
+	}
+	s.state = stateClosed
+	return s.conn.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/eskoltech/ethstats-server/journal"
+	log "github.com/sirupsen/logrus"
+)
+
+// replay sends the traffic recorded in journal files to a running server. The
+// arguments are the replay flags followed by the journal files, or the
+// directories that contain them
+func replay(args []string) {
+	commands := flag.NewFlagSet("replay", flag.ExitOnError)
+	url := commands.String("url", "ws://localhost:3000/api", "Websocket endpoint of the server that receives the traffic")
+	secret := commands.String("secret", "", "Secret sent by the replayed nodes")
+	speed := commands.Float64("speed", 1, "Pace of the replayed traffic, like 2 for twice as fast, or zero to send it without waiting")
+	commands.Parse(args)
+
+	var files []string
+	for _, path := range commands.Args() {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		journals, err := journal.Files(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = append(files, journals...)
+	}
+	if len(files) == 0 {
+		log.Fatal("No journal files to replay")
+	}
+	log.Infof("Replaying %d journal files to %s", len(files), *url)
+	err := journal.Replay(files, journal.ReplayConfig{URL: *url, Secret: *secret, Speed: *speed})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,122 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/eskoltech/ethstats-server/message"
+)
+
+// anyType is the message type used by rules that apply to all messages
+const anyType string = ""
+
+// credentials are the rules always applied by the sanitizer, so node secrets
+// never reach dashboard clients
+var credentials = []Rule{
+	{Type: message.TypeHello, Path: []string{"secret"}},
+}
+
+// ErrInvalidRule is returned when a redaction rule can't be parsed
+var ErrInvalidRule = errors.New("invalid redaction rule")
+
+// Rule removes a field from the value of the messages emitted by the nodes
+type Rule struct {
+	// Type of the message the rule applies to. If empty, the rule applies
+	// to all messages
+	Type string
+
+	// Path to the field to remove, relative to the emitted value. Arrays found
+	// in the path are traversed, so the rule applies to each element
+	Path []string
+}
+
+// ParseRule parses a rule with the format [type:]field[.field...], for
+// example "hello:info.port" or "id"
+func ParseRule(rule string) (Rule, error) {
+	msgType, path := anyType, strings.TrimSpace(rule)
+	if i := strings.Index(path, ":"); i >= 0 {
+		msgType, path = path[:i], path[i+1:]
+	}
+	fields := strings.Split(path, ".")
+	for _, field := range fields {
+		if field == "" {
+			return Rule{}, ErrInvalidRule
+		}
+	}
+	return Rule{Type: msgType, Path: fields}, nil
+}
+
+// ParseRules parses a comma separated list of rules. An empty string
+// returns no rules
+func ParseRules(rules string) ([]Rule, error) {
+	var result []Rule
+	if strings.TrimSpace(rules) == "" {
+		return result, nil
+	}
+	for _, r := range strings.Split(rules, ",") {
+		rule, err := ParseRule(r)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+// Sanitizer rewrites the messages sent by the nodes before they are broadcast,
+// removing credentials and any other sensitive field
+type Sanitizer struct {
+	rules map[string][]Rule
+}
+
+// New creates a new Sanitizer with the given rules. Rules to strip node
+// credentials are always included
+func New(rules ...Rule) *Sanitizer {
+	s := &Sanitizer{rules: make(map[string][]Rule)}
+	for _, r := range append(credentials, rules...) {
+		s.rules[r.Type] = append(s.rules[r.Type], r)
+	}
+	return s
+}
+
+// Sanitize return the content of the given message without the redacted
+// fields. If no rule applies to the message type, the content is returned
+// untouched
+func (s *Sanitizer) Sanitize(msg *message.Message) ([]byte, error) {
+	if len(msg.Value) == 0 || len(s.rules[anyType]) == 0 && len(s.rules[msg.Type]) == 0 {
+		return msg.Content, nil
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(msg.Value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	for _, rule := range s.rules[anyType] {
+		redact(value, rule.Path)
+	}
+	for _, rule := range s.rules[msg.Type] {
+		redact(value, rule.Path)
+	}
+	return json.Marshal(map[string][]interface{}{"emit": {msg.Type, value}})
+}
+
+// redact removes the field in the given path from the value
+func redact(value interface{}, path []string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+			return
+		}
+		if next, ok := v[path[0]]; ok {
+			redact(next, path[1:])
+		}
+	case []interface{}:
+		for _, e := range v {
+			redact(e, path)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package sanitize
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/eskoltech/ethstats-server/message"
+)
+
+// sanitize return the value of the sanitized message, decoded
+func sanitize(t *testing.T, s *Sanitizer, msgType string, value interface{}) map[string]interface{} {
+	msg, err := message.New(msgType, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := s.Sanitize(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sanitized, err := message.Parse(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sanitized.Type != msgType {
+		t.Fatalf("Sanitized message type = %s, want %s", sanitized.Type, msgType)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(sanitized.Value, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestHelloSecretRemoved(t *testing.T) {
+	hello := message.AuthMessage{ID: "node-1", Secret: "s3cr3t", Info: message.NodeInfo{Name: "node-1"}}
+	tests := map[string][]Rule{
+		"no rules":    nil,
+		"other rules": {{Type: message.TypeHello, Path: []string{"info", "name"}}, {Path: []string{"id"}}},
+		"same field":  {{Type: message.TypeHello, Path: []string{"secret"}}},
+	}
+	for name, rules := range tests {
+		t.Run(name, func(t *testing.T) {
+			value := sanitize(t, New(rules...), message.TypeHello, hello)
+			if _, ok := value["secret"]; ok {
+				t.Errorf("Secret kept in the sanitized hello message: %v", value)
+			}
+			if _, ok := value["info"]; !ok {
+				t.Errorf("Info removed from the sanitized hello message: %v", value)
+			}
+		})
+	}
+}
+
+func TestSanitizeArrays(t *testing.T) {
+	rules, err := ParseRules("history.miner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := message.HistoryReport{ID: "node-1", History: []message.BlockStats{
+		{Number: 1, Miner: "0x1"},
+		{Number: 2, Miner: "0x2"},
+	}}
+	value := sanitize(t, New(rules...), message.TypeHistory, history)
+	blocks := value["history"].([]interface{})
+	if len(blocks) != 2 {
+		t.Fatalf("Sanitized history has %d blocks, want 2", len(blocks))
+	}
+	for _, b := range blocks {
+		block := b.(map[string]interface{})
+		if _, ok := block["miner"]; ok {
+			t.Errorf("Miner kept in block %v", block["number"])
+		}
+		if _, ok := block["number"]; !ok {
+			t.Errorf("Number removed from block %v", block)
+		}
+	}
+}
+
+func TestSanitizeUntouched(t *testing.T) {
+	msg, err := message.New(message.TypeStats, message.StatsReport{ID: "node-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := New().Sanitize(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(msg.Content) {
+		t.Errorf("Sanitize changed a message without rules: %s", content)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		rule string
+		want Rule
+		err  error
+	}{
+		{rule: "id", want: Rule{Path: []string{"id"}}},
+		{rule: "hello:info.port", want: Rule{Type: message.TypeHello, Path: []string{"info", "port"}}},
+		{rule: "type:a.b", want: Rule{Type: "type", Path: []string{"a", "b"}}},
+		{rule: " history.miner ", want: Rule{Path: []string{"history", "miner"}}},
+		{rule: "", err: ErrInvalidRule},
+		{rule: "hello:", err: ErrInvalidRule},
+		{rule: "a..b", err: ErrInvalidRule},
+		{rule: "a.", err: ErrInvalidRule},
+	}
+	for _, test := range tests {
+		rule, err := ParseRule(test.rule)
+		if err != test.err {
+			t.Errorf("ParseRule(%q) error = %v, want %v", test.rule, err, test.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(rule, test.want) {
+			t.Errorf("ParseRule(%q) = %+v, want %+v", test.rule, rule, test.want)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("")
+	if err != nil || len(rules) != 0 {
+		t.Errorf("ParseRules(\"\") = %v, %v, want no rules", rules, err)
+	}
+	rules, err = ParseRules("hello:info.port,history.miner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{Type: message.TypeHello, Path: []string{"info", "port"}},
+		{Path: []string{"history", "miner"}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("ParseRules = %+v, want %+v", rules, want)
+	}
+	if _, err := ParseRules("id,,port"); err != ErrInvalidRule {
+		t.Errorf("ParseRules with an empty rule error = %v, want %v", err, ErrInvalidRule)
+	}
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/api"
+	"github.com/eskoltech/ethstats-server/broadcast"
+	"github.com/eskoltech/ethstats-server/chain"
+	"github.com/eskoltech/ethstats-server/journal"
+	"github.com/eskoltech/ethstats-server/metrics"
+	"github.com/eskoltech/ethstats-server/relay"
+	"github.com/eskoltech/ethstats-server/sanitize"
+	"github.com/eskoltech/ethstats-server/service"
+	"github.com/eskoltech/ethstats-server/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// writeTimeout is the maximum time to write a message to a dashboard client
+	writeTimeout = 10 * time.Second
+
+	// chartsInterval is the time between charts updates sent to the clients
+	chartsInterval = 5 * time.Second
+
+	// compactInterval is the time between compactions of the store
+	compactInterval = time.Minute
+)
+
+// errNoAuth is returned when the server is created without an authenticator
+var errNoAuth = errors.New("nodes can't be authenticated, auth is required")
+
+// Options contains the settings used by the server. Zero values disable the
+// optional features, like in the flags of the command
+type Options struct {
+	// Addr is the address the server listens on when it's started, like
+	// localhost:3000. If empty, localhost:3000 is used
+	Addr string
+
+	// Auth decides which nodes can report stats, like a
+	// relay.SecretAuthenticator. Required
+	Auth relay.Authenticator
+
+	// Logger is used to log the activity of the server. If nil, the standard
+	// logger is used
+	Logger log.FieldLogger
+
+	// Store keeps the history of nodes and blocks. Stored nodes and blocks
+	// are loaded when the server is created, and the store is never closed by
+	// the server. If nil, the history is kept in memory
+	Store storage.Store
+
+	// Duplicates is the policy for nodes connecting with the id of a
+	// connected node, and Labels the labels of the nodes keyed by id
+	Duplicates service.DuplicatePolicy
+	Labels     map[string]string
+
+	// AuthTimeout is the time a node has to authenticate after connecting,
+	// and InactiveTimeout the time it can stay without reporting
+	AuthTimeout     time.Duration
+	InactiveTimeout time.Duration
+
+	// Sanitizer rewrites node messages before they are published. If nil,
+	// only node credentials are removed
+	Sanitizer *sanitize.Sanitizer
+
+	// HistoryLimit is the maximum number of blocks requested to a node, and
+	// HistoryInterval the minimum time between requests to the same node
+	HistoryLimit    int
+	HistoryInterval time.Duration
+
+	// Journal records the traffic received from the nodes, if not nil
+	Journal *journal.Writer
+
+	// QueueSize, Overflow, Protocol and Backlog are the settings used to
+	// talk to the dashboard clients
+	QueueSize int
+	Overflow  broadcast.OverflowPolicy
+	Protocol  broadcast.Protocol
+	Backlog   int
+
+	// Window is the number of blocks used to compute the network stats, also
+	// the number of heights whose blocks are kept in the store, and
+	// ForkThreshold the time nodes can follow different chains before a
+	// chain split is reported
+	Window        int
+	ForkThreshold time.Duration
+
+	// Retention is the time the stored stats of each tier are kept. If nil,
+	// the default retention is used
+	Retention map[string]time.Duration
+}
+
+// Server is an ethstats server that can be embedded in other programs. It
+// relays the stats reported by the nodes to the dashboard clients, and serves
+// the HTTP API and the metrics
+type Server struct {
+	options   Options
+	logger    log.FieldLogger
+	channel   *service.Channel
+	relay     *relay.NodeRelay
+	broadcast *broadcast.Server
+	engine    *chain.Engine
+	detector  *chain.Detector
+	recorder  *storage.Recorder
+	compactor *storage.Compactor
+	handler   *http.ServeMux
+	http      *http.Server
+
+	lock     sync.Mutex
+	listener net.Listener
+	shutdown sync.Once
+}
+
+// New creates a new Server with the given options, ready to handle requests
+func New(options Options) (*Server, error) {
+	if options.Auth == nil {
+		return nil, errNoAuth
+	}
+	if options.Addr == "" {
+		options.Addr = "localhost:3000"
+	}
+	if options.Logger == nil {
+		options.Logger = log.StandardLogger()
+	}
+	if options.Store == nil {
+		options.Store = storage.NewMemory()
+	}
+	if options.Retention == nil {
+		retention, err := storage.ParseRetention("")
+		if err != nil {
+			return nil, err
+		}
+		options.Retention = retention
+	}
+	s := &Server{options: options, logger: options.Logger}
+
+	// Service channel to exchange info
+	s.channel = &service.Channel{
+		Message: make(chan service.Message, 1024),
+		Nodes:   service.NewRegistry(options.Duplicates),
+		Logger:  options.Logger,
+	}
+	s.channel.Nodes.SetLabels(options.Labels)
+	nodes, err := options.Store.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		s.channel.Nodes.Restore(node.Registered())
+	}
+	blocks, err := options.Store.Blocks(options.Window)
+	if err != nil {
+		return nil, err
+	}
+
+	s.compactor = storage.NewCompactor(options.Store, storage.CompactorConfig{
+		Interval:  compactInterval,
+		Retention: options.Retention,
+		Blocks:    options.Window,
+		Logger:    options.Logger,
+	})
+	s.relay = relay.New(s.channel, relay.Config{
+		Auth:            options.Auth,
+		AuthTimeout:     options.AuthTimeout,
+		InactiveTimeout: options.InactiveTimeout,
+		Sanitizer:       options.Sanitizer,
+		HistoryLimit:    options.HistoryLimit,
+		HistoryInterval: options.HistoryInterval,
+		Journal:         options.Journal,
+	})
+	s.engine = chain.New(chain.Config{
+		Window:   options.Window,
+		Interval: chartsInterval,
+		StatsTTL: options.InactiveTimeout,
+	}, s.channel)
+	for _, block := range blocks {
+		s.engine.AddBlock(block.BlockStats, block.Arrived)
+	}
+	s.detector = chain.NewDetector(chain.DetectorConfig{
+		Window:    options.Window,
+		Threshold: options.ForkThreshold,
+	}, s.channel)
+	leaderboard := chain.NewLeaderboard(options.Window, s.channel)
+	s.recorder = storage.NewRecorder(options.Store, s.channel)
+	s.channel.Consumers = []service.Consumer{s.engine, s.detector, leaderboard, s.recorder}
+	s.channel.Gaps = s.engine
+
+	s.broadcast = broadcast.New(s.channel, broadcast.Config{
+		QueueSize:    options.QueueSize,
+		Overflow:     options.Overflow,
+		WriteTimeout: writeTimeout,
+		Protocol:     options.Protocol,
+		Backlog:      options.Backlog,
+	})
+
+	s.handler = http.NewServeMux()
+	s.handler.HandleFunc(relay.Api, s.relay.HandleRequest)
+	s.handler.HandleFunc(broadcast.Root, s.broadcast.HandleRequest)
+	s.handler.HandleFunc(broadcast.Primus, s.broadcast.HandleRequest)
+	s.handler.HandleFunc(broadcast.Events, s.broadcast.HandleEvents)
+	s.handler.Handle(chain.Miners, leaderboard)
+	s.handler.Handle(api.Root, api.New(s.channel, s.engine, s.detector, options.Store))
+	s.handler.Handle(metrics.Path, metrics.New(s.channel, s.relay, s.broadcast))
+	s.http = &http.Server{Handler: s.handler}
+	return s, nil
+}
+
+// Handler return the handler of all the endpoints of the server, so it can be
+// served by another HTTP server
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Start listens on the address of the options and serves the requests in a
+// new goroutine. The context is only used while the address is bound
+func (s *Server) Start(ctx context.Context) error {
+	var config net.ListenConfig
+	listener, err := config.Listen(ctx, "tcp", s.options.Addr)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.listener = listener
+	s.lock.Unlock()
+	s.logger.Infof("Starting websocket server in %s", listener.Addr())
+	go func() {
+		if err := s.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("Server stopped serving requests, error: %s", err)
+		}
+	}()
+	return nil
+}
+
+// Addr return the address the server listens on, empty if it's not started
+func (s *Server) Addr() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Shutdown closes the connections of the nodes and the dashboard clients,
+// stops the background work and waits until the pending requests finish or
+// the context is done. The server can't be started again
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := http.ErrServerClosed
+	s.shutdown.Do(func() {
+		s.logger.Info("Shutting down the server")
+		// nodes are closed before the clients, so the messages they
+		// already sent are queued to the clients
+		s.engine.Close()
+		s.detector.Close()
+		s.relay.Close()
+		s.broadcast.Close()
+		s.recorder.Close()
+		s.compactor.Close()
+		err = s.http.Shutdown(ctx)
+	})
+	return err
+}
@@ -0,0 +1,358 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChangeType is the kind of change made to the registry
+type ChangeType int
+
+const (
+	// NodeConnected is notified when a node connects to the relay server
+	NodeConnected ChangeType = iota
+	// NodeDisconnected is notified when the connection with a node is closed
+	NodeDisconnected
+	// NodeRemoved is notified when a node is removed from the registry
+	NodeRemoved
+)
+
+// DuplicatePolicy is the behaviour of the registry when a node connects using
+// the id of a node that is already connected
+type DuplicatePolicy int
+
+const (
+	// RejectDuplicate rejects the new connection
+	RejectDuplicate DuplicatePolicy = iota
+	// ReplaceDuplicate closes the old connection and keeps the new one
+	ReplaceDuplicate
+	// SuffixDuplicate registers the new connection adding a numeric suffix
+	// to the id, like "node-2"
+	SuffixDuplicate
+)
+
+// ErrDuplicateNode is returned when a node is rejected because there is
+// another connected node using the same id
+var ErrDuplicateNode = errors.New("node with the same id already connected")
+
+// ParseDuplicatePolicy return the policy with the given name: reject, replace or suffix
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch name {
+	case "reject":
+		return RejectDuplicate, nil
+	case "replace":
+		return ReplaceDuplicate, nil
+	case "suffix":
+		return SuffixDuplicate, nil
+	}
+	return RejectDuplicate, fmt.Errorf("unknown duplicate policy %q", name)
+}
+
+// ParseLabels return the labels of the nodes from a comma separated list of
+// id=label pairs, like "node-1=eu,node-2=us"
+func ParseLabels(list string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid node label %q", pair)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// Node is a node registered in the relay server. Nodes are kept after they
+// disconnect, so a node that reconnects keeps its history and counters
+type Node struct {
+	// ID that identifies the node
+	ID string
+
+	// Label is the label given to the node in the server settings, used to
+	// group nodes. Empty if the node has no label
+	Label string
+
+	// Hello is the sanitized hello message sent by the node
+	Hello []byte
+
+	// Active is true while the node is connected
+	Active bool
+
+	// Connections is the number of times the node connected to the server
+	Connections int
+
+	// Messages is the number of messages received from the node
+	Messages uint64
+
+	// FirstSeen is the first time the node connected to the server
+	FirstSeen time.Time
+
+	// LastSeen is the last time the node sent a message
+	LastSeen time.Time
+
+	// Latest contains the last sanitized message of each type sent by the node
+	Latest map[string][]byte
+}
+
+// Change is a notification sent to the registry watchers. The node is a copy,
+// so it can be used without holding the registry lock
+type Change struct {
+	Type ChangeType
+	Node Node
+}
+
+// entry is a registered node and the connection used to report it. The
+// reported id is the one sent by the node, different from the id of the node
+// if it was suffixed, and it's used to find the label of the node
+type entry struct {
+	node     Node
+	reported string
+	conn     io.Closer
+}
+
+// copy return a copy of the node that can be used without holding the lock
+func (e *entry) copy() Node {
+	node := e.node
+	node.Latest = make(map[string][]byte, len(e.node.Latest))
+	for msgType, content := range e.node.Latest {
+		node.Latest[msgType] = content
+	}
+	return node
+}
+
+// Registry contains the nodes known by the relay server, keyed by the id they
+// report. It's safe for concurrent use
+type Registry struct {
+	lock     sync.RWMutex
+	policy   DuplicatePolicy
+	labels   map[string]string
+	nodes    map[string]*entry
+	watchers []chan Change
+}
+
+// NewRegistry creates a new empty Registry that handles duplicated ids using
+// the given policy
+func NewRegistry(policy DuplicatePolicy) *Registry {
+	return &Registry{
+		policy: policy,
+		labels: make(map[string]string),
+		nodes:  make(map[string]*entry),
+	}
+}
+
+// SetLabels sets the labels of the nodes, keyed by the id they report. Nodes
+// registered with a suffixed id get the label of the reported one
+func (r *Registry) SetLabels(labels map[string]string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.labels = make(map[string]string, len(labels))
+	for id, label := range labels {
+		r.labels[id] = label
+	}
+	for _, e := range r.nodes {
+		e.node.Label = r.labels[e.reported]
+	}
+}
+
+// Connect registers the connection of the node with the given id and return
+// the id assigned to it. Depending on the duplicate policy, the assigned id can
+// differ from the given one, or ErrDuplicateNode is returned
+func (r *Registry) Connect(id string, conn io.Closer) (string, error) {
+	r.lock.Lock()
+	reported := id
+	label := r.labels[reported]
+	var replaced io.Closer
+	if e, ok := r.nodes[id]; ok && e.node.Active {
+		switch r.policy {
+		case RejectDuplicate:
+			r.lock.Unlock()
+			return "", ErrDuplicateNode
+		case ReplaceDuplicate:
+			replaced = e.conn
+		case SuffixDuplicate:
+			id = r.suffix(id)
+		}
+	}
+	now := time.Now()
+	e, ok := r.nodes[id]
+	if !ok {
+		e = &entry{node: Node{ID: id, FirstSeen: now, Latest: make(map[string][]byte)}}
+		r.nodes[id] = e
+	}
+	e.reported = reported
+	if e.node.Label == "" {
+		e.node.Label = label
+	}
+	e.conn = conn
+	e.node.Active = true
+	e.node.Connections++
+	e.node.LastSeen = now
+	r.notify(Change{Type: NodeConnected, Node: e.copy()})
+	r.lock.Unlock()
+
+	// close the old connection without holding the lock
+	if replaced != nil {
+		replaced.Close()
+	}
+	return id, nil
+}
+
+// suffix return the first id, built adding a numeric suffix to the given one,
+// that isn't used by a connected node. Must be called holding the lock
+func (r *Registry) suffix(id string) string {
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s-%d", id, i)
+		if e, ok := r.nodes[candidate]; !ok || !e.node.Active {
+			return candidate
+		}
+	}
+}
+
+// Disconnect marks the node as inactive, only if it's still reported using
+// the given connection. It return true if the node was marked as inactive
+func (r *Registry) Disconnect(id string, conn io.Closer) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	e, ok := r.nodes[id]
+	if !ok || e.conn != conn {
+		return false
+	}
+	e.conn = nil
+	e.node.Active = false
+	r.notify(Change{Type: NodeDisconnected, Node: e.copy()})
+	return true
+}
+
+// SetHello stores the hello message sent by the node
+func (r *Registry) SetHello(id string, hello []byte) {
+	r.lock.Lock()
+	if e, ok := r.nodes[id]; ok {
+		e.node.Hello = hello
+	}
+	r.lock.Unlock()
+}
+
+// SetLatest stores the last message of the given type sent by the node
+func (r *Registry) SetLatest(id, msgType string, content []byte) {
+	r.lock.Lock()
+	if e, ok := r.nodes[id]; ok {
+		e.node.Latest[msgType] = content
+	}
+	r.lock.Unlock()
+}
+
+// Touch updates the counters of the node after receiving a message
+func (r *Registry) Touch(id string) {
+	r.lock.Lock()
+	if e, ok := r.nodes[id]; ok {
+		e.node.Messages++
+		e.node.LastSeen = time.Now()
+	}
+	r.lock.Unlock()
+}
+
+// Restore adds an inactive node known from a previous run of the server, so
+// it keeps its history and counters. Nodes already registered are ignored
+func (r *Registry) Restore(node Node) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.nodes[node.ID]; ok {
+		return
+	}
+	if label, ok := r.labels[node.ID]; ok {
+		node.Label = label
+	}
+	node.Active = false
+	if node.Latest == nil {
+		node.Latest = make(map[string][]byte)
+	}
+	r.nodes[node.ID] = &entry{node: node, reported: node.ID}
+}
+
+// Remove removes the node with the given id from the registry
+func (r *Registry) Remove(id string) {
+	r.lock.Lock()
+	if e, ok := r.nodes[id]; ok {
+		delete(r.nodes, id)
+		r.notify(Change{Type: NodeRemoved, Node: e.copy()})
+	}
+	r.lock.Unlock()
+}
+
+// Get return the node with the given id
+func (r *Registry) Get(id string) (Node, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	e, ok := r.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	return e.copy(), true
+}
+
+// Label return the label of the node with the given id, empty if the node
+// is unknown or has no label
+func (r *Registry) Label(id string) string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if e, ok := r.nodes[id]; ok {
+		return e.node.Label
+	}
+	return ""
+}
+
+// Len return the number of connected nodes
+func (r *Registry) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	connected := 0
+	for _, e := range r.nodes {
+		if e.node.Active {
+			connected++
+		}
+	}
+	return connected
+}
+
+// Snapshot return a copy of the registered nodes sorted by id, so it can be
+// iterated without holding the registry lock
+func (r *Registry) Snapshot() []Node {
+	r.lock.RLock()
+	nodes := make([]Node, 0, len(r.nodes))
+	for _, e := range r.nodes {
+		nodes = append(nodes, e.copy())
+	}
+	r.lock.RUnlock()
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// Watch return a channel that receives the changes made to the registry.
+// Watchers that don't keep up with the changes miss them, so a slow watcher
+// never blocks the registry
+func (r *Registry) Watch(buffer int) <-chan Change {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	watcher := make(chan Change, buffer)
+	r.watchers = append(r.watchers, watcher)
+	return watcher
+}
+
+// notify sends the change to all watchers. Must be called holding the lock
+func (r *Registry) notify(change Change) {
+	for _, watcher := range r.watchers {
+		select {
+		case watcher <- change:
+		default:
+		}
+	}
+}
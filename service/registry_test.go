@@ -0,0 +1,186 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// closer is a connection that does nothing when closed
+type closer struct{}
+
+func (closer) Close() error { return nil }
+
+func TestSetLabelsSuffixedNode(t *testing.T) {
+	r := NewRegistry(SuffixDuplicate)
+	r.SetLabels(map[string]string{"node-1": "eu"})
+	if _, err := r.Connect("node-1", closer{}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := r.Connect("node-1", closer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "node-1-2" {
+		t.Fatalf("Connect id = %s, want node-1-2", id)
+	}
+	if label := r.Label(id); label != "eu" {
+		t.Errorf("Label after Connect = %q, want eu", label)
+	}
+	r.SetLabels(map[string]string{"node-1": "us"})
+	for _, id := range []string{"node-1", "node-1-2"} {
+		if label := r.Label(id); label != "us" {
+			t.Errorf("Label(%s) after SetLabels = %q, want us", id, label)
+		}
+	}
+}
+
+// conn is a connection that counts how many times it was closed
+type conn struct {
+	closed int32
+}
+
+func (c *conn) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return nil
+}
+
+func TestConnectDuplicatePolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy DuplicatePolicy
+		id     string
+		err    error
+		closed int32
+	}{
+		{name: "reject", policy: RejectDuplicate, err: ErrDuplicateNode},
+		{name: "replace", policy: ReplaceDuplicate, id: "node-1", closed: 1},
+		{name: "suffix", policy: SuffixDuplicate, id: "node-1-2"},
+	}
+	for _, test := range tests {
+		r := NewRegistry(test.policy)
+		first := &conn{}
+		if _, err := r.Connect("node-1", first); err != nil {
+			t.Fatal(err)
+		}
+		id, err := r.Connect("node-1", &conn{})
+		if id != test.id || err != test.err {
+			t.Errorf("%s: Connect = %q, %v, want %q, %v", test.name, id, err, test.id, test.err)
+		}
+		if closed := atomic.LoadInt32(&first.closed); closed != test.closed {
+			t.Errorf("%s: first connection closed %d times, want %d", test.name, closed, test.closed)
+		}
+		// the first connection never marks the node of the second one inactive
+		r.Disconnect("node-1", first)
+		if node, ok := r.Get("node-1"); test.policy == ReplaceDuplicate && (!ok || !node.Active) {
+			t.Errorf("%s: replaced connection disconnected the node", test.name)
+		}
+	}
+}
+
+func TestConnectSuffixReusesInactiveIds(t *testing.T) {
+	r := NewRegistry(SuffixDuplicate)
+	conns := []*conn{{}, {}, {}}
+	for i, want := range []string{"node-1", "node-1-2", "node-1-3"} {
+		id, err := r.Connect("node-1", conns[i])
+		if err != nil || id != want {
+			t.Fatalf("Connect = %q, %v, want %q", id, err, want)
+		}
+	}
+	r.Disconnect("node-1-2", conns[1])
+	if id, _ := r.Connect("node-1", &conn{}); id != "node-1-2" {
+		t.Errorf("Connect = %q, want the inactive node-1-2", id)
+	}
+	if connected := r.Len(); connected != 3 {
+		t.Errorf("Len = %d, want 3", connected)
+	}
+}
+
+func TestReconnectKeepsCounters(t *testing.T) {
+	r := NewRegistry(RejectDuplicate)
+	first := &conn{}
+	if _, err := r.Connect("node-1", first); err != nil {
+		t.Fatal(err)
+	}
+	r.Touch("node-1")
+	r.Touch("node-1")
+	r.SetLatest("node-1", "stats", []byte("{}"))
+	before, _ := r.Get("node-1")
+	r.Disconnect("node-1", first)
+	if node, _ := r.Get("node-1"); node.Active {
+		t.Error("Node active after disconnecting")
+	}
+	if _, err := r.Connect("node-1", &conn{}); err != nil {
+		t.Fatal(err)
+	}
+	node, _ := r.Get("node-1")
+	if !node.Active || node.Connections != 2 || node.Messages != 2 {
+		t.Errorf("Node after reconnecting = %+v, want active with 2 connections and 2 messages", node)
+	}
+	if !node.FirstSeen.Equal(before.FirstSeen) {
+		t.Errorf("FirstSeen = %s after reconnecting, want %s", node.FirstSeen, before.FirstSeen)
+	}
+	if string(node.Latest["stats"]) != "{}" {
+		t.Error("Latest messages lost after reconnecting")
+	}
+}
+
+func TestWatchReceivesCopies(t *testing.T) {
+	r := NewRegistry(RejectDuplicate)
+	changes := r.Watch(16)
+	c := &conn{}
+	if _, err := r.Connect("node-1", c); err != nil {
+		t.Fatal(err)
+	}
+	connected := <-changes
+	r.SetLatest("node-1", "stats", []byte("{}"))
+	if _, ok := connected.Node.Latest["stats"]; ok {
+		t.Error("Latest message set after connecting is visible in the change")
+	}
+	r.Disconnect("node-1", c)
+	if disconnected := <-changes; disconnected.Type != NodeDisconnected || disconnected.Node.Active {
+		t.Errorf("Change after disconnecting = %+v, want an inactive node", disconnected)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	r := NewRegistry(SuffixDuplicate)
+	changes := r.Watch(1024)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for change := range changes {
+			for range change.Node.Latest {
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				c := &conn{}
+				id, err := r.Connect("node-1", c)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				r.Touch(id)
+				r.SetLatest(id, "stats", []byte("{}"))
+				r.Snapshot()
+				r.Disconnect(id, c)
+			}
+		}()
+	}
+	wg.Wait()
+	if connected := r.Len(); connected != 0 {
+		t.Errorf("Len = %d after disconnecting all nodes, want 0", connected)
+	}
+	r.lock.Lock()
+	for _, watcher := range r.watchers {
+		close(watcher)
+	}
+	r.lock.Unlock()
+	<-done
+}
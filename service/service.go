@@ -1,10 +1,63 @@
 package service
 
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Consumer processes the reports of the authenticated nodes
+type Consumer interface {
+	// Consume is called with the decoded value of every message reported by
+	// an authenticated node, from the goroutine reading the node connection.
+	// The id is the one assigned by the registry
+	Consume(id string, value interface{}, received time.Time)
+}
+
+// GapFinder finds the blocks missing in the history of the network
+type GapFinder interface {
+	// Missing return up to limit block numbers that aren't known, counting
+	// back from the given head. If head is zero, the best known block is used
+	Missing(head uint64, limit int) []uint64
+}
+
+// Message is a message sent to the clients. Its type and node are known by
+// the sender, so the message is never parsed again to filter it
+type Message struct {
+	// Content is the message in the format emitted by the nodes
+	Content []byte
+
+	// Type of the message, and Node the id of the node it's about, empty if
+	// the message isn't about a single node
+	Type string
+	Node string
+}
+
 // Channel is the service whereby servers exchange info
 type Channel struct {
-	// Message is the content of the stats reported by the Ethereum node
-	Message chan []byte
+	// Message is the content of the stats reported by the Ethereum node, and
+	// of the messages emitted by this server
+	Message chan Message
 
 	// Nodes registered to the relay server
-	Nodes map[string][]byte
+	Nodes *Registry
+
+	// Consumers of the node reports, like the chain aggregation engine
+	Consumers []Consumer
+
+	// Gaps finds the blocks that can be requested to the nodes to complete
+	// the history. If nil, history is never requested
+	Gaps GapFinder
+
+	// Logger is used by the servers to log their activity. If nil, the
+	// standard logger is used
+	Logger log.FieldLogger
+}
+
+// Log return the logger used by the servers
+func (c *Channel) Log() log.FieldLogger {
+	if c.Logger == nil {
+		return log.StandardLogger()
+	}
+	return c.Logger
 }
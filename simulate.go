@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/relay"
+	"github.com/eskoltech/ethstats-server/simulator"
+	log "github.com/sirupsen/logrus"
+)
+
+// simulate runs fake nodes that report to a running server, or to a server
+// started in this process if the serve flag is given, until it's interrupted
+func simulate(args []string) {
+	commands := flag.NewFlagSet("simulate", flag.ExitOnError)
+	url := commands.String("url", "ws://localhost:3000/api", "Websocket endpoint of the server that receives the stats")
+	listen := commands.String("serve", "", "Address of a server started in this process to receive the stats, instead of using url")
+	nodeSecret := commands.String("secret", "", "Secret sent by the fake nodes")
+	nodes := commands.Int("nodes", 10, "Number of fake nodes")
+	miners := commands.Int("miners", 3, "Number of fake nodes that mine blocks")
+	blockTime := commands.Duration("block-time", 15*time.Second, "Average time between blocks")
+	latency := commands.Duration("latency", 100*time.Millisecond, "Average latency of the fake nodes")
+	jitter := commands.Duration("jitter", 50*time.Millisecond, "Standard deviation of the latency of the fake nodes")
+	churn := commands.Int("churn", 2, "Maximum change of the peers of a node between two stats reports")
+	forkRate := commands.Float64("fork-rate", 0.05, "Probability of a block having a competing block at the same height")
+	disconnectRate := commands.Float64("disconnect-rate", 0.01, "Probability, per minute, of a fake node dropping its connection")
+	seed := commands.Int64("seed", time.Now().UnixNano(), "Seed of the random generator, to repeat a simulation")
+	commands.Parse(args)
+
+	if *nodes < 1 {
+		log.Fatal("Number of fake nodes can't be less than 1")
+	}
+	if *listen != "" {
+		*addr = *listen
+		*secret = *nodeSecret
+		*url = "ws://" + *listen + relay.Api
+		srv, release := newServer()
+		defer release()
+		// the address is bound when the server is started, so the nodes
+		// can connect right away
+		if err := srv.Start(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+		defer shutdown(srv)
+	}
+	sim := simulator.New(simulator.Config{
+		URL:            *url,
+		Secret:         *nodeSecret,
+		Nodes:          *nodes,
+		Miners:         *miners,
+		BlockTime:      *blockTime,
+		Latency:        *latency,
+		Jitter:         *jitter,
+		Churn:          *churn,
+		ForkRate:       *forkRate,
+		DisconnectRate: *disconnectRate,
+		Seed:           *seed,
+	})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	log.Info("Stopping the simulation")
+	sim.Close()
+}
@@ -0,0 +1,216 @@
+package simulator
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pingInterval, statsInterval and pendingInterval are the times between
+	// the reports of each kind sent by a fake node, like geth does
+	pingInterval    = 3 * time.Second
+	statsInterval   = 5 * time.Second
+	pendingInterval = 2 * time.Second
+)
+
+// node is a fake Ethereum node that reports the blocks it imports
+type node struct {
+	sim     *Simulator
+	id      string
+	mining  bool
+	blocks  chan message.BlockStats
+	history map[uint64]message.BlockStats
+	peers   int
+	started time.Time
+}
+
+// newNode creates a new fake node of the simulator
+func newNode(sim *Simulator, id string, mining bool) *node {
+	return &node{
+		sim:     sim,
+		id:      id,
+		mining:  mining,
+		blocks:  make(chan message.BlockStats, 16),
+		history: make(map[uint64]message.BlockStats),
+		peers:   10 + sim.intn(15),
+		started: time.Now(),
+	}
+}
+
+// deliver makes the node import the block after the given delay
+func (n *node) deliver(block message.BlockStats, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		select {
+		case n.blocks <- block:
+		default:
+		}
+	})
+}
+
+// run keeps the node connected to the relay until the simulator is closed.
+// When the connection drops, the node connects again after a few seconds
+func (n *node) run() {
+	for {
+		if err := n.session(); err != nil {
+			log.Warningf("Fake node[%s] disconnected, %s", n.id, err)
+		}
+		select {
+		case <-n.sim.quit:
+			return
+		case <-time.After(time.Duration(1+n.sim.intn(10)) * time.Second):
+		}
+	}
+}
+
+// session connects the node to the relay and reports until the connection is
+// dropped. It return nil if the simulator is closed
+func (n *node) session() error {
+	conn, _, err := websocket.DefaultDialer.Dial(n.sim.config.URL, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	incoming := make(chan []byte, 16)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(incoming)
+		for {
+			_, content, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case incoming <- content:
+			case <-done:
+				return
+			}
+		}
+	}()
+	hello := message.AuthMessage{
+		ID:     n.id,
+		Secret: n.sim.config.Secret,
+		Info: message.NodeInfo{
+			Name:     n.id,
+			Node:     "Simulator/v1.0.0",
+			Port:     30303,
+			Network:  "1337",
+			Protocol: "eth/63",
+			API:      "No",
+			Os:       "linux",
+			OsVer:    "amd64",
+			Client:   "0.1.1",
+			History:  true,
+		},
+	}
+	if err := n.send(conn, message.TypeHello, hello); err != nil {
+		return err
+	}
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	stats := time.NewTicker(statsInterval)
+	defer stats.Stop()
+	pending := time.NewTicker(pendingInterval)
+	defer pending.Stop()
+	disconnect := time.NewTicker(time.Second)
+	defer disconnect.Stop()
+	for {
+		var err error
+		select {
+		case <-n.sim.quit:
+			return nil
+		case content, ok := <-incoming:
+			if !ok {
+				return errConnectionClosed
+			}
+			err = n.handle(conn, content)
+		case block := <-n.blocks:
+			n.history[block.Number] = block
+			delete(n.history, block.Number-historyBlocks)
+			err = n.send(conn, message.TypeBlock, message.BlockReport{ID: n.id, Block: block})
+		case <-ping.C:
+			err = n.send(conn, message.TypePing, message.NodePing{ID: n.id, Time: time.Now().String()})
+		case <-stats.C:
+			err = n.send(conn, message.TypeStats, message.StatsReport{ID: n.id, Stats: n.stats()})
+		case <-pending.C:
+			err = n.send(conn, message.TypePending, message.PendingReport{ID: n.id, Stats: message.PendingStats{Pending: n.sim.intn(200)}})
+		case <-disconnect.C:
+			if n.sim.float() < n.sim.config.DisconnectRate/60 {
+				log.Infof("Fake node[%s] dropping its connection", n.id)
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers the messages sent by the relay: the latency is reported
+// after each pong, and history requests are answered with the known blocks
+func (n *node) handle(conn *websocket.Conn, content []byte) error {
+	var frame struct {
+		Emit []json.RawMessage `json:"emit"`
+	}
+	if err := json.Unmarshal(content, &frame); err != nil || len(frame.Emit) == 0 {
+		return nil
+	}
+	var msgType string
+	if err := json.Unmarshal(frame.Emit[0], &msgType); err != nil {
+		return nil
+	}
+	switch msgType {
+	case "node-pong":
+		latency := n.sim.randomLatency() / time.Millisecond
+		return n.send(conn, message.TypeLatency, message.LatencyReport{ID: n.id, Latency: strconv.Itoa(int(latency))})
+	case message.TypeHistory:
+		var request message.HistoryRequest
+		if len(frame.Emit) < 2 || json.Unmarshal(frame.Emit[1], &request) != nil {
+			return nil
+		}
+		report := message.HistoryReport{ID: n.id, History: []message.BlockStats{}}
+		for _, number := range request.List {
+			if block, ok := n.history[number]; ok {
+				report.History = append(report.History, block)
+			}
+		}
+		return n.send(conn, message.TypeHistory, report)
+	}
+	return nil
+}
+
+// stats return the status of the node, changing its peers randomly
+func (n *node) stats() message.NodeStats {
+	if churn := n.sim.config.Churn; churn > 0 {
+		n.peers += n.sim.intn(2*churn+1) - churn
+		if n.peers < 0 {
+			n.peers = 0
+		}
+	}
+	stats := message.NodeStats{
+		Active:   true,
+		Mining:   n.mining,
+		Peers:    n.peers,
+		GasPrice: 1000000000,
+		Uptime:   100,
+	}
+	if n.mining {
+		stats.Hashrate = 1000000 + n.sim.intn(100000)
+	}
+	return stats
+}
+
+// send sends a message to the relay
+func (n *node) send(conn *websocket.Conn, msgType string, value interface{}) error {
+	msg, err := message.New(msgType, value)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, msg.Content)
+}
@@ -0,0 +1,246 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	log "github.com/sirupsen/logrus"
+)
+
+// errConnectionClosed is returned when the relay closes the connection of a fake node
+var errConnectionClosed = errors.New("connection closed by the server")
+
+// historyBlocks is the number of blocks each fake node remembers to answer
+// history requests
+const historyBlocks = 1000
+
+// Config contains the settings used by the simulator
+type Config struct {
+	// URL is the websocket endpoint of the relay, like ws://localhost:3000/api
+	URL string
+
+	// Secret is the secret sent by the fake nodes
+	Secret string
+
+	// Nodes is the number of fake nodes. At least one node is simulated
+	Nodes int
+
+	// Miners is the number of fake nodes that mine blocks
+	Miners int
+
+	// BlockTime is the average time between blocks
+	BlockTime time.Duration
+
+	// Latency and Jitter are the mean and the standard deviation of the
+	// latency between the nodes and the server, also used as the delay
+	// between a block being mined and a node importing it
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Churn is the maximum change of the number of peers of a node between
+	// two stats reports
+	Churn int
+
+	// ForkRate is the probability of a block having a competing block at
+	// the same height, imported first by some of the nodes
+	ForkRate float64
+
+	// DisconnectRate is the probability, per minute, of a node dropping its
+	// connection. Disconnected nodes connect again after a few seconds
+	DisconnectRate float64
+
+	// Seed of the random generator, so simulations can be repeated
+	Seed int64
+}
+
+// Simulator runs fake Ethereum nodes that report a fake chain to the relay
+type Simulator struct {
+	config Config
+	nodes  []*node
+	quit   chan struct{}
+	wg     sync.WaitGroup
+
+	// lock protects the random generator and the chain
+	lock   sync.Mutex
+	random *rand.Rand
+	head   message.BlockStats
+	td     *big.Int
+}
+
+// New creates a new Simulator and starts its nodes and its chain
+func New(config Config) *Simulator {
+	defer func() { log.Infof("Simulating %d nodes reporting to %s", config.Nodes, config.URL) }()
+	if config.BlockTime <= 0 {
+		config.BlockTime = 15 * time.Second
+	}
+	if config.Nodes <= 0 {
+		config.Nodes = 1
+	}
+	if config.Miners <= 0 || config.Miners > config.Nodes {
+		config.Miners = config.Nodes
+	}
+	s := &Simulator{
+		config: config,
+		quit:   make(chan struct{}),
+		random: rand.New(rand.NewSource(config.Seed)),
+		td:     big.NewInt(0),
+	}
+	s.head = message.BlockStats{Hash: s.hash(), Timestamp: uint64(time.Now().Unix())}
+	for i := 0; i < config.Nodes; i++ {
+		n := newNode(s, fmt.Sprintf("sim-%d", i+1), i < config.Miners)
+		s.nodes = append(s.nodes, n)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			n.run()
+		}()
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.loop()
+	}()
+	return s
+}
+
+// Close stops the nodes and waits until they disconnect
+func (s *Simulator) Close() {
+	close(s.quit)
+	s.wg.Wait()
+}
+
+// loop mines a new block every block time, on average
+func (s *Simulator) loop() {
+	delay := s.blockDelay()
+	for {
+		select {
+		case <-time.After(delay):
+			delay = s.blockDelay()
+			s.mine(delay)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// mine creates the next block of the chain and sends it to the nodes. If the
+// block has a competing block, some nodes import the competing one first and
+// reorganize to the canonical one before the next block, mined after the given
+// time, arrives
+func (s *Simulator) mine(next time.Duration) {
+	s.lock.Lock()
+	block := s.next(s.head)
+	s.head = block
+	var fork *message.BlockStats
+	if s.random.Float64() < s.config.ForkRate {
+		sibling := s.next(message.BlockStats{Number: block.Number - 1, Hash: block.ParentHash, Timestamp: block.Timestamp - 1})
+		sibling.TotalDifficulty = block.TotalDifficulty
+		fork = &sibling
+	}
+	delays := make([]time.Duration, len(s.nodes))
+	forked := make([]bool, len(s.nodes))
+	for i := range s.nodes {
+		delays[i] = s.latency()
+		forked[i] = fork != nil && s.random.Intn(2) == 0
+	}
+	s.lock.Unlock()
+
+	if fork != nil {
+		log.Infof("Simulating fork at block %d", block.Number)
+	}
+	for i, n := range s.nodes {
+		// a block can't be imported before its parent, so every node
+		// imports the block before the next one arrives
+		delay := delays[i]
+		if delay > next/2 {
+			delay = next / 2
+		}
+		if forked[i] {
+			// the node imports the competing block first, and then
+			// reorganizes to the canonical one before the next block
+			reorg := delay + time.Second
+			if half := (next - delay) / 2; half < reorg {
+				reorg = half
+			}
+			n.deliver(*fork, delay)
+			n.deliver(block, delay+reorg)
+			continue
+		}
+		n.deliver(block, delay)
+	}
+}
+
+// next return a new block on top of the parent. Must be called holding the lock
+func (s *Simulator) next(parent message.BlockStats) message.BlockStats {
+	difficulty := big.NewInt(int64(1000000 + s.random.Intn(1000)))
+	s.td.Add(s.td, difficulty)
+	txs := make([]message.TxStats, s.random.Intn(50))
+	for i := range txs {
+		txs[i] = message.TxStats{Hash: s.hash()}
+	}
+	gasLimit := uint64(8000000)
+	return message.BlockStats{
+		Number:          parent.Number + 1,
+		Hash:            s.hash(),
+		ParentHash:      parent.Hash,
+		Timestamp:       parent.Timestamp + uint64(s.config.BlockTime/time.Second) + uint64(s.random.Intn(3)),
+		Miner:           fmt.Sprintf("0x%040x", s.random.Intn(s.config.Miners)+1),
+		GasUsed:         uint64(len(txs)) * 21000,
+		GasLimit:        gasLimit,
+		Difficulty:      difficulty.String(),
+		TotalDifficulty: s.td.String(),
+		Transactions:    txs,
+		TxHash:          s.hash(),
+		Root:            s.hash(),
+		Uncles:          []message.Uncle{},
+	}
+}
+
+// hash return a random block or transaction hash. Must be called holding the lock
+func (s *Simulator) hash() string {
+	return fmt.Sprintf("0x%016x%016x%016x%016x", s.random.Uint64(), s.random.Uint64(), s.random.Uint64(), s.random.Uint64())
+}
+
+// latency return a random latency following a normal distribution with the
+// configured mean and standard deviation. Must be called holding the lock
+func (s *Simulator) latency() time.Duration {
+	latency := time.Duration(s.random.NormFloat64()*float64(s.config.Jitter)) + s.config.Latency
+	if latency < 0 {
+		return 0
+	}
+	return latency
+}
+
+// blockDelay return the time until the next block, following an exponential
+// distribution like proof of work blocks
+func (s *Simulator) blockDelay() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Duration(s.random.ExpFloat64() * float64(s.config.BlockTime))
+}
+
+// intn return a random number in [0, n), safe for concurrent use
+func (s *Simulator) intn(n int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.random.Intn(n)
+}
+
+// float return a random number in [0.0, 1.0), safe for concurrent use
+func (s *Simulator) float() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.random.Float64()
+}
+
+// randomLatency return a random latency, safe for concurrent use
+func (s *Simulator) randomLatency() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.latency()
+}
@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	nodesFile   = "nodes.jsonl"
+	blocksFile  = "blocks.jsonl"
+	samplesDir  = "samples"
+	rollupsFile = "rollups-%s.jsonl"
+
+	// segmentFormat is the name of the files where the samples of each hour are stored
+	segmentFormat = "2006010215"
+)
+
+// Disk is a Store that keeps the history in a directory, so it survives
+// restarts. Each kind of record is appended to its own file, one JSON
+// document per line, and everything is loaded in memory when the store is
+// opened. Samples are stored in a file per hour, so old samples are pruned
+// removing files. It's safe for concurrent use
+type Disk struct {
+	*Memory
+	dir     string
+	nodes   *journal
+	blocks  *journal
+	samples *segments
+	rollups map[string]*journal
+}
+
+// Open opens the store in the given directory, creating it if it doesn't
+// exist, and loads the stored history
+func Open(dir string) (*Disk, error) {
+	if err := os.MkdirAll(filepath.Join(dir, samplesDir), 0755); err != nil {
+		return nil, err
+	}
+	d := &Disk{Memory: NewMemory(), dir: dir, rollups: make(map[string]*journal)}
+	err := load(filepath.Join(dir, nodesFile), func(decoder *json.Decoder) error {
+		var node Node
+		if err := decoder.Decode(&node); err != nil {
+			return err
+		}
+		return d.Memory.SaveNode(node)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = load(filepath.Join(dir, blocksFile), func(decoder *json.Decoder) error {
+		var block Block
+		if err := decoder.Decode(&block); err != nil {
+			return err
+		}
+		_, err := d.Memory.AddBlock(block)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, samplesDir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		err = load(file, func(decoder *json.Decoder) error {
+			var sample Sample
+			if err := decoder.Decode(&sample); err != nil {
+				return err
+			}
+			return d.Memory.AddSample(sample)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range tiers {
+		tier := t.name
+		err = load(d.rollupsPath(tier), func(decoder *json.Decoder) error {
+			var rollup Rollup
+			if err := decoder.Decode(&rollup); err != nil {
+				return err
+			}
+			return d.Memory.AddRollups(tier, []Rollup{rollup})
+		})
+		if err != nil {
+			return nil, err
+		}
+		if d.rollups[tier], err = openJournal(d.rollupsPath(tier)); err != nil {
+			return nil, err
+		}
+	}
+	// nodes are saved many times, keep only the last version of each one
+	nodes, _ := d.Memory.Nodes()
+	records := make([]interface{}, 0, len(nodes))
+	for _, node := range nodes {
+		records = append(records, node)
+	}
+	if err := rewrite(filepath.Join(dir, nodesFile), records); err != nil {
+		return nil, err
+	}
+	if d.nodes, err = openJournal(filepath.Join(dir, nodesFile)); err != nil {
+		return nil, err
+	}
+	// blocks pruned while the file was only appended are removed from it
+	blocks := d.blockRecords()
+	if err := rewrite(filepath.Join(dir, blocksFile), blocks); err != nil {
+		return nil, err
+	}
+	if d.blocks, err = openJournal(filepath.Join(dir, blocksFile)); err != nil {
+		return nil, err
+	}
+	d.samples = &segments{dir: filepath.Join(dir, samplesDir)}
+	log.Infof("Loaded %d nodes and %d blocks from %s", len(nodes), len(blocks), dir)
+	return d, nil
+}
+
+// SaveNode stores the node metadata, replacing the previous one
+func (d *Disk) SaveNode(node Node) error {
+	if err := d.Memory.SaveNode(node); err != nil {
+		return err
+	}
+	return d.nodes.append(node)
+}
+
+// AddSample stores a sample of a node metric
+func (d *Disk) AddSample(sample Sample) error {
+	if err := d.Memory.AddSample(sample); err != nil {
+		return err
+	}
+	return d.samples.append(sample, sample.Time)
+}
+
+// AddRollups stores the aggregated samples of the given tier
+func (d *Disk) AddRollups(tier string, rollups []Rollup) error {
+	j, ok := d.rollups[tier]
+	if !ok {
+		return d.Memory.AddRollups(tier, rollups)
+	}
+	if err := d.Memory.AddRollups(tier, rollups); err != nil {
+		return err
+	}
+	for _, rollup := range rollups {
+		if err := j.append(rollup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune removes the samples, or the rollups of the given tier, taken before
+// the given time. Samples are removed by whole hours, so the files of the
+// hours that finished before the given time are deleted. The file of the
+// rollups is only rewritten when some rollup is removed
+func (d *Disk) Prune(tier string, before time.Time) error {
+	removed := d.Memory.prune(tier, before)
+	if tier == Raw {
+		return d.samples.prune(before)
+	}
+	j, ok := d.rollups[tier]
+	if !ok || removed == 0 {
+		return nil
+	}
+	rollups := d.Memory.all(tier)
+	records := make([]interface{}, 0, len(rollups))
+	for _, rollup := range rollups {
+		records = append(records, rollup)
+	}
+	return j.replace(records)
+}
+
+// AddBlock stores the block, if it's not already stored
+func (d *Disk) AddBlock(block Block) (bool, error) {
+	added, err := d.Memory.AddBlock(block)
+	if err != nil || !added {
+		return added, err
+	}
+	return true, d.blocks.append(block)
+}
+
+// PruneBlocks removes the stored blocks out of the last heights. The file of
+// the blocks is only rewritten when some block is removed
+func (d *Disk) PruneBlocks(heights int) error {
+	if d.Memory.pruneBlocks(heights) == 0 {
+		return nil
+	}
+	return d.blocks.replace(d.blockRecords())
+}
+
+// Close closes the files of the store
+func (d *Disk) Close() error {
+	journals := []*journal{d.nodes, d.blocks}
+	for _, j := range d.rollups {
+		journals = append(journals, j)
+	}
+	result := d.samples.close()
+	for _, j := range journals {
+		if err := j.close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// blockRecords return the blocks kept in memory, sorted by number
+func (d *Disk) blockRecords() []interface{} {
+	blocks, _ := d.Memory.Blocks(0)
+	records := make([]interface{}, 0, len(blocks))
+	for _, block := range blocks {
+		records = append(records, block)
+	}
+	return records
+}
+
+// rollupsPath return the path of the file with the rollups of the tier
+func (d *Disk) rollupsPath(tier string) string {
+	return filepath.Join(d.dir, fmt.Sprintf(rollupsFile, tier))
+}
+
+// journal is a file where records are appended, one per line
+type journal struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+// openJournal opens the file to append records to it
+func openJournal(path string) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{path: path, file: file}, nil
+}
+
+// append writes the record at the end of the file
+func (j *journal) append(record interface{}) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	_, err = j.file.Write(append(content, '\n'))
+	return err
+}
+
+// replace replaces the records of the file with the given ones
+func (j *journal) replace(records []interface{}) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	err := rewrite(j.path, records)
+	file, openErr := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if openErr != nil {
+		return openErr
+	}
+	j.file = file
+	return err
+}
+
+// close closes the file
+func (j *journal) close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.file.Close()
+}
+
+// segments is a journal split in a file per hour, named after the hour
+type segments struct {
+	lock    sync.Mutex
+	dir     string
+	current string
+	file    *os.File
+}
+
+// append writes the record at the end of the file of the hour of the given time
+func (s *segments) append(record interface{}, t time.Time) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	segment := t.UTC().Format(segmentFormat)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if segment != s.current || s.file == nil {
+		if s.file != nil {
+			s.file.Close()
+		}
+		path := filepath.Join(s.dir, segment+".jsonl")
+		if s.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			s.file = nil
+			return err
+		}
+		s.current = segment
+	}
+	_, err = s.file.Write(append(content, '\n'))
+	return err
+}
+
+// prune removes the files of the hours finished before the given time
+func (s *segments) prune(before time.Time) error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, file := range files {
+		segment := strings.TrimSuffix(filepath.Base(file), ".jsonl")
+		start, err := time.Parse(segmentFormat, segment)
+		if err != nil || start.Add(time.Hour).After(before) {
+			continue
+		}
+		if segment == s.current && s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close closes the file of the current hour
+func (s *segments) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// load decodes the records of the file. A record that can't be decoded, like
+// the last one if the server stopped while writing it, ends the loading
+func load(path string, decode func(decoder *json.Decoder) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		if err := decode(decoder); err != nil {
+			log.Warningf("Ignoring the rest of %s, invalid record: %s", path, err)
+			return nil
+		}
+	}
+	return nil
+}
+
+// rewrite replaces the content of the file with the given records. The new
+// content is written to a temporary file first, so the file is never left
+// half written
+func rewrite(path string, records []interface{}) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Store that keeps everything in memory, so the history is lost
+// when the server stops. It's safe for concurrent use
+type Memory struct {
+	lock    sync.RWMutex
+	nodes   map[string]Node
+	samples map[string][]Sample
+	rollups map[string]map[string][]Rollup
+	blocks  map[string]Block
+}
+
+// NewMemory creates a new empty Memory store
+func NewMemory() *Memory {
+	return &Memory{
+		nodes:   make(map[string]Node),
+		samples: make(map[string][]Sample),
+		rollups: make(map[string]map[string][]Rollup),
+		blocks:  make(map[string]Block),
+	}
+}
+
+// SaveNode stores the node metadata, replacing the previous one
+func (m *Memory) SaveNode(node Node) error {
+	m.lock.Lock()
+	m.nodes[node.ID] = node
+	m.lock.Unlock()
+	return nil
+}
+
+// Nodes return all stored nodes sorted by id
+func (m *Memory) Nodes() ([]Node, error) {
+	m.lock.RLock()
+	nodes := make([]Node, 0, len(m.nodes))
+	for _, node := range m.nodes {
+		nodes = append(nodes, node)
+	}
+	m.lock.RUnlock()
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// AddSample stores a sample of a node metric
+func (m *Memory) AddSample(sample Sample) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := sampleKey(sample.Node, sample.Metric)
+	samples := append(m.samples[key], sample)
+	// samples usually arrive in order, only sort when they don't. The series
+	// can be read without holding the lock, so it's sorted in a copy
+	if n := len(samples); n > 1 && samples[n-1].Time.Before(samples[n-2].Time) {
+		samples = append([]Sample(nil), samples...)
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	}
+	m.samples[key] = samples
+	return nil
+}
+
+// Samples return the samples of the node metric in the given time range,
+// sorted by time. If the node or the metric are empty, all of them are returned
+func (m *Memory) Samples(node, metric string, from, to time.Time) ([]Sample, error) {
+	// stored samples are never modified, so only the part of each series in
+	// the range is found holding the lock, and it's copied after releasing it
+	m.lock.RLock()
+	var parts [][]Sample
+	for key, series := range m.samples {
+		if !matchKey(key, node, metric) {
+			continue
+		}
+		start := sort.Search(len(series), func(i int) bool { return !series[i].Time.Before(from) })
+		end := sort.Search(len(series), func(i int) bool { return !series[i].Time.Before(to) })
+		if start < end {
+			parts = append(parts, series[start:end])
+		}
+	}
+	m.lock.RUnlock()
+	var samples []Sample
+	for _, part := range parts {
+		samples = append(samples, part...)
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	return samples, nil
+}
+
+// AddRollups stores the aggregated samples of the given tier
+func (m *Memory) AddRollups(tier string, rollups []Rollup) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	series, ok := m.rollups[tier]
+	if !ok {
+		series = make(map[string][]Rollup)
+		m.rollups[tier] = series
+	}
+	for _, rollup := range rollups {
+		key := sampleKey(rollup.Node, rollup.Metric)
+		stored := append(series[key], rollup)
+		// like samples, the series is sorted in a copy when needed
+		if n := len(stored); n > 1 && stored[n-1].Time.Before(stored[n-2].Time) {
+			stored = append([]Rollup(nil), stored...)
+			sort.SliceStable(stored, func(i, j int) bool { return stored[i].Time.Before(stored[j].Time) })
+		}
+		series[key] = stored
+	}
+	return nil
+}
+
+// Rollups return the aggregated samples of the given tier in the time range,
+// sorted by time. If the node or the metric are empty, all of them are returned
+func (m *Memory) Rollups(tier, node, metric string, from, to time.Time) ([]Rollup, error) {
+	m.lock.RLock()
+	var parts [][]Rollup
+	for key, series := range m.rollups[tier] {
+		if !matchKey(key, node, metric) {
+			continue
+		}
+		start := sort.Search(len(series), func(i int) bool { return !series[i].Time.Before(from) })
+		end := sort.Search(len(series), func(i int) bool { return !series[i].Time.Before(to) })
+		if start < end {
+			parts = append(parts, series[start:end])
+		}
+	}
+	m.lock.RUnlock()
+	var rollups []Rollup
+	for _, part := range parts {
+		rollups = append(rollups, part...)
+	}
+	sort.SliceStable(rollups, func(i, j int) bool { return rollups[i].Time.Before(rollups[j].Time) })
+	return rollups, nil
+}
+
+// all return all the rollups of the given tier, sorted by time
+func (m *Memory) all(tier string) []Rollup {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var rollups []Rollup
+	for _, series := range m.rollups[tier] {
+		rollups = append(rollups, series...)
+	}
+	sort.SliceStable(rollups, func(i, j int) bool { return rollups[i].Time.Before(rollups[j].Time) })
+	return rollups
+}
+
+// Prune removes the samples, or the rollups of the given tier, taken before
+// the given time
+func (m *Memory) Prune(tier string, before time.Time) error {
+	m.prune(tier, before)
+	return nil
+}
+
+// prune removes the samples, or the rollups of the given tier, taken before
+// the given time, and return the number of samples or rollups removed
+func (m *Memory) prune(tier string, before time.Time) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	removed := 0
+	if tier == Raw {
+		for key, series := range m.samples {
+			n := sort.Search(len(series), func(i int) bool { return !series[i].Time.Before(before) })
+			removed += n
+			if n == len(series) {
+				delete(m.samples, key)
+			} else if n > 0 {
+				m.samples[key] = append([]Sample(nil), series[n:]...)
+			}
+		}
+		return removed
+	}
+	for key, series := range m.rollups[tier] {
+		n := sort.Search(len(series), func(i int) bool { return !series[i].Time.Before(before) })
+		removed += n
+		if n == len(series) {
+			delete(m.rollups[tier], key)
+		} else if n > 0 {
+			m.rollups[tier][key] = append([]Rollup(nil), series[n:]...)
+		}
+	}
+	return removed
+}
+
+// AddBlock stores the block, if it's not already stored
+func (m *Memory) AddBlock(block Block) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.blocks[block.Hash]; ok {
+		return false, nil
+	}
+	m.blocks[block.Hash] = block
+	return true, nil
+}
+
+// Block return the stored block with the given hash
+func (m *Memory) Block(hash string) (Block, bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	block, ok := m.blocks[hash]
+	return block, ok, nil
+}
+
+// Blocks return the stored blocks of the last heights, sorted by number
+func (m *Memory) Blocks(heights int) ([]Block, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	highest := m.highest()
+	var blocks []Block
+	for _, block := range m.blocks {
+		if heights > 0 && block.Number+uint64(heights) <= highest {
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Number < blocks[j].Number })
+	return blocks, nil
+}
+
+// PruneBlocks removes the stored blocks out of the last heights
+func (m *Memory) PruneBlocks(heights int) error {
+	m.pruneBlocks(heights)
+	return nil
+}
+
+// pruneBlocks removes the stored blocks out of the last heights, and return
+// the number of blocks removed
+func (m *Memory) pruneBlocks(heights int) int {
+	if heights <= 0 {
+		return 0
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	highest := m.highest()
+	removed := 0
+	for hash, block := range m.blocks {
+		if block.Number+uint64(heights) <= highest {
+			delete(m.blocks, hash)
+			removed++
+		}
+	}
+	return removed
+}
+
+// highest return the number of the highest stored block. The lock must be held
+func (m *Memory) highest() uint64 {
+	var highest uint64
+	for _, block := range m.blocks {
+		if block.Number > highest {
+			highest = block.Number
+		}
+	}
+	return highest
+}
+
+// Close does nothing, the history is kept until the store is garbage collected
+func (m *Memory) Close() error {
+	return nil
+}
+
+// sampleKey return the key of the samples of a node metric
+func sampleKey(node, metric string) string {
+	return node + "\x00" + metric
+}
+
+// matchKey return true if the key is of the given node and metric. Empty
+// values match any node or metric
+func matchKey(key, node, metric string) bool {
+	parts := strings.SplitN(key, "\x00", 2)
+	return (node == "" || parts[0] == node) && (metric == "" || parts[1] == metric)
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemorySamplesRange(t *testing.T) {
+	m := NewMemory()
+	start := time.Date(2019, 2, 10, 12, 0, 0, 0, time.UTC)
+	// the second sample arrives out of order
+	for _, offset := range []int{0, 2, 1, 3, 4} {
+		for _, node := range []string{"node-1", "node-2"} {
+			sample := Sample{Node: node, Metric: MetricPeers, Time: start.Add(time.Duration(offset) * time.Minute), Value: float64(offset)}
+			if err := m.AddSample(sample); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	samples, err := m.Samples("node-1", MetricPeers, start.Add(time.Minute), start.Add(4*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []float64
+	for _, sample := range samples {
+		values = append(values, sample.Value)
+	}
+	if len(values) != 3 || values[0] != 1 || values[1] != 2 || values[2] != 3 {
+		t.Errorf("Samples values = %v, want [1 2 3]", values)
+	}
+	if all, _ := m.Samples("", "", start, start.Add(time.Hour)); len(all) != 10 {
+		t.Errorf("Samples of all nodes return %d samples, want 10", len(all))
+	}
+}
+
+func TestMemoryConcurrentReads(t *testing.T) {
+	m := NewMemory()
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 1000; n++ {
+			// every tenth sample arrives late
+			offset := time.Duration(n) * time.Second
+			if n%10 == 0 {
+				offset -= 5 * time.Second
+			}
+			m.AddSample(Sample{Node: "node-1", Metric: MetricPeers, Time: start.Add(offset)})
+			m.AddRollups(Minute, []Rollup{{Node: "node-1", Metric: MetricPeers, Time: start.Add(offset)}})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 200; n++ {
+			samples, _ := m.Samples("", "", start.Add(-time.Minute), start.Add(time.Hour))
+			for i := 1; i < len(samples); i++ {
+				if samples[i].Time.Before(samples[i-1].Time) {
+					t.Error("Samples not sorted by time")
+					return
+				}
+			}
+			m.Rollups(Minute, "", "", start.Add(-time.Minute), start.Add(time.Hour))
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+)
+
+// Recorder writes the reports of the nodes to a store. Node metadata is saved
+// when nodes connect and disconnect, and when the recorder is closed
+type Recorder struct {
+	store   Store
+	service *service.Channel
+	changes <-chan service.Change
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// NewRecorder creates a new Recorder and starts saving the nodes of the service
+func NewRecorder(store Store, service *service.Channel) *Recorder {
+	defer func() { service.Log().Info("Storage recorder started successfully") }()
+	r := &Recorder{
+		store:   store,
+		service: service,
+		changes: service.Nodes.Watch(64),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go r.loop()
+	return r
+}
+
+// Close saves all known nodes and stops the recorder
+func (r *Recorder) Close() {
+	close(r.quit)
+	<-r.done
+	for _, node := range r.service.Nodes.Snapshot() {
+		r.saveNode(node)
+	}
+}
+
+// Consume stores the blocks and the samples of the metrics reported by the nodes
+func (r *Recorder) Consume(id string, value interface{}, received time.Time) {
+	switch v := value.(type) {
+	case *message.BlockReport:
+		r.addBlock(id, v.Block, received, true)
+	case *message.HistoryReport:
+		for _, block := range v.History {
+			r.addBlock(id, block, received, false)
+		}
+	case *message.StatsReport:
+		r.addSample(id, MetricPeers, received, float64(v.Stats.Peers))
+		r.addSample(id, MetricGasPrice, received, float64(v.Stats.GasPrice))
+	case *message.PendingReport:
+		r.addSample(id, MetricPending, received, float64(v.Stats.Pending))
+	case *message.LatencyReport:
+		if latency, err := strconv.ParseFloat(v.Latency, 64); err == nil {
+			r.addSample(id, MetricLatency, received, latency)
+		}
+	}
+}
+
+// addBlock stores the block. For blocks reported as new, the gas used and
+// the propagation delay, since the block was first stored, are sampled
+func (r *Recorder) addBlock(id string, stats message.BlockStats, received time.Time, sample bool) {
+	block := Block{BlockStats: stats, Arrived: received}
+	if known, ok, err := r.store.Block(stats.Hash); err == nil && ok {
+		block = known
+	} else if _, err := r.store.AddBlock(block); err != nil {
+		r.service.Log().Warningf("Can't store block %d reported by node[%s], error: %s", stats.Number, id, err)
+	}
+	if !sample {
+		return
+	}
+	r.addSample(id, MetricGasUsed, received, float64(stats.GasUsed))
+	r.addSample(id, MetricPropagation, received, float64(received.Sub(block.Arrived)/time.Millisecond))
+}
+
+// addSample stores a sample of the node metric
+func (r *Recorder) addSample(id, metric string, received time.Time, value float64) {
+	sample := Sample{Node: id, Metric: metric, Time: received, Value: value}
+	if err := r.store.AddSample(sample); err != nil {
+		r.service.Log().Warningf("Can't store %s of node[%s], error: %s", metric, id, err)
+	}
+}
+
+// saveNode stores the metadata of the node
+func (r *Recorder) saveNode(node service.Node) {
+	if err := r.store.SaveNode(NewNode(node)); err != nil {
+		r.service.Log().Warningf("Can't store node[%s], error: %s", node.ID, err)
+	}
+}
+
+// loop saves the nodes when they connect or disconnect. The registry changes
+// contain the node as it was when the change happened, so the node is read
+// again to store its last state
+func (r *Recorder) loop() {
+	defer close(r.done)
+	for {
+		select {
+		case change := <-r.changes:
+			if change.Type == service.NodeRemoved {
+				continue
+			}
+			if node, ok := r.service.Nodes.Get(change.Node.ID); ok {
+				r.saveNode(node)
+			}
+		case <-r.quit:
+			return
+		}
+	}
+}
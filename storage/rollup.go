@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Raw is the tier of the samples reported by the nodes
+	Raw string = "raw"
+	// Minute is the tier of the samples aggregated by minute
+	Minute string = "1m"
+	// Hour is the tier of the samples aggregated by hour
+	Hour string = "1h"
+	// Day is the tier of the samples aggregated by day
+	Day string = "1d"
+)
+
+// tier is a level of aggregation, computed from the previous tier
+type tier struct {
+	name       string
+	source     string
+	resolution time.Duration
+}
+
+// tiers are the aggregation levels, from the finest to the coarsest
+var tiers = []tier{
+	{name: Minute, source: Raw, resolution: time.Minute},
+	{name: Hour, source: Minute, resolution: time.Hour},
+	{name: Day, source: Hour, resolution: 24 * time.Hour},
+}
+
+// Rollup is the aggregation of the samples of a node metric taken in the
+// period that starts at the given time
+type Rollup struct {
+	Node   string    `json:"node"`
+	Metric string    `json:"metric"`
+	Time   time.Time `json:"time"`
+	Count  int       `json:"count"`
+	Min    float64   `json:"min"`
+	Max    float64   `json:"max"`
+	Avg    float64   `json:"avg"`
+	Last   float64   `json:"last"`
+}
+
+// ParseRetention return the retention of each tier from a comma separated
+// list of tier=duration pairs, like "raw=6h,1m=48h". Tiers that aren't in the
+// list keep the default retention, and a zero duration keeps them forever
+func ParseRetention(list string) (map[string]time.Duration, error) {
+	retention := map[string]time.Duration{
+		Raw:    6 * time.Hour,
+		Minute: 48 * time.Hour,
+		Hour:   30 * 24 * time.Hour,
+		Day:    0,
+	}
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if _, ok := retention[parts[0]]; !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid retention %q, use raw, 1m, 1h or 1d=duration", pair)
+		}
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid retention %q", pair)
+		}
+		retention[parts[0]] = duration
+	}
+	return retention, nil
+}
+
+// CompactorConfig contains the settings used by the compactor
+type CompactorConfig struct {
+	// Interval is the time between compactions
+	Interval time.Duration
+
+	// Retention is the time the samples and the rollups of each tier are
+	// kept. Tiers without retention are kept forever
+	Retention map[string]time.Duration
+
+	// Blocks is the number of the last heights whose blocks are kept. If
+	// zero, blocks are kept forever
+	Blocks int
+
+	// Logger is used to log the compactions. If nil, the standard logger is used
+	Logger log.FieldLogger
+}
+
+// Compactor rolls up the samples of the store into coarser tiers and removes
+// the data out of the retention of each tier. It runs in its own goroutine,
+// so the store is never compacted while the nodes report
+type Compactor struct {
+	store  Store
+	config CompactorConfig
+
+	// next is the start of the first period of each tier not rolled up yet
+	next map[string]time.Time
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewCompactor creates a new Compactor and starts compacting the store
+func NewCompactor(store Store, config CompactorConfig) *Compactor {
+	if config.Logger == nil {
+		config.Logger = log.StandardLogger()
+	}
+	defer func() { config.Logger.Info("Storage compactor started successfully") }()
+	if config.Interval <= 0 {
+		config.Interval = time.Minute
+	}
+	c := &Compactor{
+		store:  store,
+		config: config,
+		next:   make(map[string]time.Time),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+// Close stops compacting the store
+func (c *Compactor) Close() {
+	close(c.quit)
+	<-c.done
+}
+
+// loop compacts the store every interval until the compactor is closed
+func (c *Compactor) loop() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	c.resume()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.compact(now)
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// resume finds where each tier was rolled up in a previous run
+func (c *Compactor) resume() {
+	for _, t := range tiers {
+		rollups, err := c.store.Rollups(t.name, "", "", time.Time{}, time.Now())
+		if err != nil {
+			c.config.Logger.Warningf("Can't read %s rollups, error: %s", t.name, err)
+			continue
+		}
+		for _, rollup := range rollups {
+			if end := rollup.Time.Add(t.resolution); end.After(c.next[t.name]) {
+				c.next[t.name] = end
+			}
+		}
+	}
+}
+
+// compact rolls up the periods of each tier finished before the given time,
+// and prunes the samples and rollups out of their retention and the blocks out
+// of the kept heights
+func (c *Compactor) compact(now time.Time) {
+	for _, t := range tiers {
+		if err := c.rollup(t, now); err != nil {
+			c.config.Logger.Warningf("Can't roll up %s samples, error: %s", t.name, err)
+		}
+	}
+	for _, name := range []string{Raw, Minute, Hour, Day} {
+		retention := c.config.Retention[name]
+		if retention <= 0 {
+			continue
+		}
+		if err := c.store.Prune(name, now.Add(-retention)); err != nil {
+			c.config.Logger.Warningf("Can't prune %s samples, error: %s", name, err)
+		}
+	}
+	if c.config.Blocks > 0 {
+		if err := c.store.PruneBlocks(c.config.Blocks); err != nil {
+			c.config.Logger.Warningf("Can't prune blocks, error: %s", err)
+		}
+	}
+}
+
+// rollup aggregates the data of the source tier in the periods of the tier
+// finished before the given time
+func (c *Compactor) rollup(t tier, now time.Time) error {
+	from := c.next[t.name]
+	to := now.Truncate(t.resolution)
+	if !from.Before(to) {
+		return nil
+	}
+	var source []Rollup
+	if t.source == Raw {
+		samples, err := c.store.Samples("", "", from, to)
+		if err != nil {
+			return err
+		}
+		for _, sample := range samples {
+			source = append(source, Rollup{
+				Node:   sample.Node,
+				Metric: sample.Metric,
+				Time:   sample.Time,
+				Count:  1,
+				Min:    sample.Value,
+				Max:    sample.Value,
+				Avg:    sample.Value,
+				Last:   sample.Value,
+			})
+		}
+	} else {
+		rollups, err := c.store.Rollups(t.source, "", "", from, to)
+		if err != nil {
+			return err
+		}
+		source = rollups
+	}
+	rollups := aggregate(source, t.resolution)
+	if len(rollups) > 0 {
+		if err := c.store.AddRollups(t.name, rollups); err != nil {
+			return err
+		}
+	}
+	c.next[t.name] = to
+	return nil
+}
+
+// aggregate merges the rollups of each node metric taken in the same period
+// of the given resolution. The rollups of each node metric must be sorted by time
+func aggregate(source []Rollup, resolution time.Duration) []Rollup {
+	merged := make(map[string]*Rollup)
+	for _, r := range source {
+		start := r.Time.Truncate(resolution)
+		key := sampleKey(r.Node, r.Metric) + "/" + start.String()
+		m, ok := merged[key]
+		if !ok {
+			m = &Rollup{Node: r.Node, Metric: r.Metric, Time: start, Min: r.Min, Max: r.Max}
+			merged[key] = m
+		}
+		if r.Min < m.Min {
+			m.Min = r.Min
+		}
+		if r.Max > m.Max {
+			m.Max = r.Max
+		}
+		m.Avg = (m.Avg*float64(m.Count) + r.Avg*float64(r.Count)) / float64(m.Count+r.Count)
+		m.Count += r.Count
+		m.Last = r.Last
+	}
+	rollups := make([]Rollup, 0, len(merged))
+	for _, m := range merged {
+		rollups = append(rollups, *m)
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		if !rollups[i].Time.Equal(rollups[j].Time) {
+			return rollups[i].Time.Before(rollups[j].Time)
+		}
+		return sampleKey(rollups[i].Node, rollups[i].Metric) < sampleKey(rollups[j].Node, rollups[j].Metric)
+	})
+	return rollups
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	start := time.Date(2019, 2, 10, 12, 0, 0, 0, time.UTC)
+	sample := func(node string, offset time.Duration, value float64) Rollup {
+		return Rollup{Node: node, Metric: MetricPeers, Time: start.Add(offset), Count: 1, Min: value, Max: value, Avg: value, Last: value}
+	}
+	source := []Rollup{
+		sample("node-1", 0, 10),
+		sample("node-2", time.Second, 1),
+		sample("node-1", 20*time.Second, 4),
+		// already aggregated values count as many samples
+		{Node: "node-1", Metric: MetricPeers, Time: start.Add(30 * time.Second), Count: 2, Min: 6, Max: 30, Avg: 18, Last: 6},
+		// the last instant of the period, and the first of the next one
+		sample("node-1", time.Minute-time.Nanosecond, 7),
+		sample("node-1", time.Minute, 100),
+	}
+	want := []Rollup{
+		{Node: "node-1", Metric: MetricPeers, Time: start, Count: 5, Min: 4, Max: 30, Avg: (10 + 4 + 2*18 + 7) / 5.0, Last: 7},
+		{Node: "node-2", Metric: MetricPeers, Time: start, Count: 1, Min: 1, Max: 1, Avg: 1, Last: 1},
+		{Node: "node-1", Metric: MetricPeers, Time: start.Add(time.Minute), Count: 1, Min: 100, Max: 100, Avg: 100, Last: 100},
+	}
+	if got := aggregate(source, time.Minute); !reflect.DeepEqual(got, want) {
+		t.Errorf("aggregate =\n%+v\nwant\n%+v", got, want)
+	}
+
+	// coarser tiers merge the rollups of the finer ones
+	hour := aggregate(want, time.Hour)
+	if len(hour) != 2 {
+		t.Fatalf("aggregate by hour return %d rollups, want 2", len(hour))
+	}
+	if r := hour[0]; r.Node != "node-1" || r.Count != 6 || r.Min != 4 || r.Max != 100 || r.Last != 100 || r.Avg != (57+100)/6.0 {
+		t.Errorf("aggregate by hour = %+v", r)
+	}
+}
+
+func TestAggregateEmpty(t *testing.T) {
+	if got := aggregate(nil, time.Minute); len(got) != 0 {
+		t.Errorf("aggregate of nothing = %+v", got)
+	}
+}
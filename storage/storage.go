@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/eskoltech/ethstats-server/message"
+	"github.com/eskoltech/ethstats-server/service"
+)
+
+const (
+	// MetricPeers is the number of peers reported by the node
+	MetricPeers string = "peers"
+	// MetricLatency is the latency between the node and the server, in milliseconds
+	MetricLatency string = "latency"
+	// MetricPending is the number of pending transactions of the node
+	MetricPending string = "pending"
+	// MetricGasPrice is the gas price reported by the node
+	MetricGasPrice string = "gasPrice"
+	// MetricGasUsed is the gas used by the last block reported by the node
+	MetricGasUsed string = "gasUsed"
+	// MetricPropagation is the propagation delay of the last block reported
+	// by the node, in milliseconds
+	MetricPropagation string = "propagation"
+)
+
+// Node is the metadata of a node kept in the store
+type Node struct {
+	ID          string                     `json:"id"`
+	Label       string                     `json:"label,omitempty"`
+	Hello       json.RawMessage            `json:"hello,omitempty"`
+	Connections int                        `json:"connections"`
+	Messages    uint64                     `json:"messages"`
+	FirstSeen   time.Time                  `json:"firstSeen"`
+	LastSeen    time.Time                  `json:"lastSeen"`
+	Latest      map[string]json.RawMessage `json:"latest,omitempty"`
+}
+
+// Sample is a value of a metric reported by a node at a given time
+type Sample struct {
+	Node   string    `json:"node"`
+	Metric string    `json:"metric"`
+	Time   time.Time `json:"time"`
+	Value  float64   `json:"value"`
+}
+
+// Block is a block reported by the nodes and the first time it arrived
+type Block struct {
+	message.BlockStats
+	Arrived time.Time `json:"arrived"`
+}
+
+// Store keeps the history of the nodes and the blocks they report. Stores
+// must be safe for concurrent use
+type Store interface {
+	// SaveNode stores the node metadata, replacing the previous one
+	SaveNode(node Node) error
+
+	// Nodes return all stored nodes sorted by id
+	Nodes() ([]Node, error)
+
+	// AddSample stores a sample of a node metric
+	AddSample(sample Sample) error
+
+	// Samples return the samples of the node metric taken from the given time
+	// until, but not including, the given end, sorted by time. If the node or
+	// the metric are empty, samples of all nodes or metrics are returned
+	Samples(node, metric string, from, to time.Time) ([]Sample, error)
+
+	// AddRollups stores the aggregated samples of the given tier
+	AddRollups(tier string, rollups []Rollup) error
+
+	// Rollups return the aggregated samples of the given tier, with the same
+	// filters as Samples
+	Rollups(tier, node, metric string, from, to time.Time) ([]Rollup, error)
+
+	// Prune removes the samples, or the rollups of the given tier, taken
+	// before the given time. Samples are pruned using the Raw tier
+	Prune(tier string, before time.Time) error
+
+	// AddBlock stores the block, if it's not already stored. It return true
+	// if the block was stored
+	AddBlock(block Block) (bool, error)
+
+	// Block return the stored block with the given hash
+	Block(hash string) (Block, bool, error)
+
+	// Blocks return the stored blocks of the last heights, sorted by number
+	Blocks(heights int) ([]Block, error)
+
+	// PruneBlocks removes the stored blocks out of the last heights
+	PruneBlocks(heights int) error
+
+	// Close releases the resources used by the store
+	Close() error
+}
+
+// NewNode return the metadata of a registered node
+func NewNode(node service.Node) Node {
+	stored := Node{
+		ID:          node.ID,
+		Label:       node.Label,
+		Connections: node.Connections,
+		Messages:    node.Messages,
+		FirstSeen:   node.FirstSeen,
+		LastSeen:    node.LastSeen,
+		Latest:      make(map[string]json.RawMessage, len(node.Latest)),
+	}
+	if node.Hello != nil {
+		stored.Hello = json.RawMessage(node.Hello)
+	}
+	for msgType, content := range node.Latest {
+		stored.Latest[msgType] = json.RawMessage(content)
+	}
+	return stored
+}
+
+// Registered return the node that is added to the registry when restoring it
+// from the store. Restored nodes are inactive until they connect again
+func (n Node) Registered() service.Node {
+	node := service.Node{
+		ID:          n.ID,
+		Label:       n.Label,
+		Hello:       []byte(n.Hello),
+		Connections: n.Connections,
+		Messages:    n.Messages,
+		FirstSeen:   n.FirstSeen,
+		LastSeen:    n.LastSeen,
+		Latest:      make(map[string][]byte, len(n.Latest)),
+	}
+	for msgType, content := range n.Latest {
+		node.Latest[msgType] = []byte(content)
+	}
+	return node
+}